@@ -0,0 +1,159 @@
+// Daemon mode and the unmount subcommand
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/amyangfei/image_viewer/viewer"
+	"github.com/jessevdk/go-flags"
+)
+
+// set in the environment of the daemon process, the value is the fd of the
+// pipe used to tell the parent process the mount is ready
+const readyFdEnv = "IMAGE_TOOL_READY_FD"
+
+var unmountOpts struct {
+	PidFile string `long:"pidfile" description:"pid file of the daemon, defaults to the one derived from mount point"`
+
+	Timeout time.Duration `long:"timeout" default:"15s" description:"how long to wait for the daemon to exit"`
+
+	Args struct {
+		MountPoint string `required:"yes"`
+	} `positional-args:"yes"`
+}
+
+// defaultPidFile returns the pid file of the daemon serving mountpoint when
+// --pidfile is not given
+func defaultPidFile(mountpoint string) string {
+	if abs, err := filepath.Abs(mountpoint); err == nil {
+		mountpoint = abs
+	}
+	sum := sha1.Sum([]byte(filepath.Clean(mountpoint)))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("image_tool-%x.pid", sum[:4]))
+}
+
+// readPidFile returns the pid in pidfile if the process is still alive
+func readPidFile(pidfile string) (int, bool) {
+	data, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, syscall.Kill(pid, 0) == nil
+}
+
+func writePidFile(pidfile string) error {
+	return ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// isDaemonChild returns whether current process is the background process
+// started by startDaemon
+func isDaemonChild() bool {
+	return os.Getenv(readyFdEnv) != ""
+}
+
+// notifyReady tells the parent process the mount is ready, it is a no-op if
+// current process is not a daemon
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyFdEnv))
+	if err != nil {
+		return
+	}
+	pipe := os.NewFile(uintptr(fd), "ready")
+	pipe.Write([]byte("ok\n"))
+	pipe.Close()
+}
+
+// startDaemon runs the same command in a new session in background, and
+// returns once the mount is ready or the background process exits
+func startDaemon(logFile string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), readyFdEnv+"=3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		defer f.Close()
+		cmd.Stdout = f
+		cmd.Stderr = f
+	}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	// the pipe is closed without data if the daemon exits before ready
+	buf := make([]byte, 3)
+	if n, _ := r.Read(buf); n > 0 {
+		fmt.Printf("image_tool daemon started, pid %d\n", cmd.Process.Pid)
+		return nil
+	}
+	cmd.Wait()
+	if logFile != "" {
+		return fmt.Errorf("daemon exits before mount is ready, see %s", logFile)
+	}
+	return fmt.Errorf("daemon exits before mount is ready")
+}
+
+// unmountMain stops the daemon serving a mount point, the mount point is
+// unmounted directly if no daemon is found
+func unmountMain(args []string) int {
+	parser := flags.NewParser(&unmountOpts, flags.PassDoubleDash|flags.HelpFlag)
+	parser.Usage = "unmount [OPTIONS] mountpoint"
+	if _, err := parser.ParseArgs(args); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	mountpoint := unmountOpts.Args.MountPoint
+	pidfile := unmountOpts.PidFile
+	if pidfile == "" {
+		pidfile = defaultPidFile(mountpoint)
+	}
+
+	pid, alive := readPidFile(pidfile)
+	if !alive {
+		if err := viewer.Unmount(mountpoint); err != nil {
+			fmt.Printf("unmount %s with error: %s\n", mountpoint, err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		fmt.Printf("stop daemon %d with error: %s\n", pid, err)
+		return 1
+	}
+	deadline := time.Now().Add(unmountOpts.Timeout)
+	for time.Now().Before(deadline) {
+		if syscall.Kill(pid, 0) != nil {
+			return 0
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Printf("daemon %d does not exit in %s\n", pid, unmountOpts.Timeout)
+	return 1
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/amyangfei/image_viewer/viewer"
 	"github.com/jessevdk/go-flags"
@@ -13,15 +16,89 @@ var opts struct {
 
 	DriverPort int `long:"driver-port" default:"9515" description:"chrome driver port"`
 
+	NumberPrefix bool `long:"number-prefix" description:"prefix image filenames with zero-padded page position"`
+
+	CacheSize int64 `long:"cache-size" default:"256" description:"memory budget of image content cache in MB, 0 means unlimited"`
+
+	CacheStatsInterval time.Duration `long:"cache-stats-interval" default:"0s" description:"interval of printing cache statistics, 0 disables it"`
+
+	CacheDir string `long:"cache-dir" description:"directory to persist images and crawled tree across remounts"`
+
+	DirTTL time.Duration `long:"dir-ttl" default:"0s" description:"re-crawl a directory in background once its listing is older than this, 0 means never"`
+
+	HostTTL []string `long:"host-ttl" description:"per host dir ttl in host=duration format, can be repeated"`
+
+	EntryTimeout time.Duration `long:"entry-timeout" default:"1s" description:"how long the kernel caches directory entries"`
+
+	AttrTimeout time.Duration `long:"attr-timeout" default:"1s" description:"how long the kernel caches file attributes"`
+
+	NegativeTimeout time.Duration `long:"negative-timeout" default:"0s" description:"how long the kernel caches failed lookups"`
+
+	Uid int `long:"uid" default:"-1" description:"owner uid of all files, -1 means the mounting user"`
+
+	Gid int `long:"gid" default:"-1" description:"owner gid of all files, -1 means the mounting user"`
+
+	Scope string `long:"scope" default:"all" choice:"all" choice:"host" choice:"prefix" description:"which sub links are listed as directories"`
+
+	Depth int `long:"depth" default:"0" description:"max directory depth under a site, 0 means unlimited"`
+
+	Sites []string `long:"site" description:"site presented as a top-level directory in name=url format, can be repeated"`
+
+	SitesConfig string `long:"sites-config" description:"json file of sites with their own headless, scope and depth options"`
+
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" default:"10s" description:"how long to wait for unmounting on SIGINT or SIGTERM before a lazy unmount"`
+
+	AllowOther bool `long:"allow-other" description:"allow other users to access the mount, needs user_allow_other in /etc/fuse.conf"`
+
+	FsName string `long:"fsname" default:"image_viewer" description:"file system name shown in mount output"`
+
+	Debug bool `long:"debug" description:"print every FUSE request and reply"`
+
+	ReadOnly bool `long:"read-only" description:"mount read-only, control files, site urls and mkdir are rejected with EROFS"`
+
+	PrefetchDepth int `long:"prefetch-depth" default:"0" description:"levels of sub directories crawled in background after a directory is listed, 0 disables prefetch"`
+
+	PrefetchPages int `long:"prefetch-pages" default:"10" description:"max pages crawled by one prefetch"`
+
+	PrefetchRate int64 `long:"prefetch-rate" default:"1024" description:"bandwidth cap of prefetch in KB/s, 0 means unlimited"`
+
+	StreamSize int64 `long:"stream-size" default:"1024" description:"files larger than this in KB are read with http range requests instead of being downloaded entirely, 0 disables streaming"`
+
+	StreamReadAhead int `long:"stream-read-ahead" default:"4" description:"number of 256KB chunks fetched ahead of the read offset of a streamed file"`
+
+	ThumbSize int `long:"thumb-size" default:"256" description:"max width and height of thumbnails in .thumbs directories in pixels"`
+
+	ThumbQuality int `long:"thumb-quality" default:"80" description:"jpeg quality of thumbnails, from 1 to 100"`
+
+	JpegQuality int `long:"jpeg-quality" default:"90" description:"jpeg quality of images transcoded in .as-jpeg directories, from 1 to 100"`
+
+	ArchiveDepth int `long:"archive-depth" default:"0" description:"levels of sub directories included in .archive.zip and .archive.tar, sub directories are crawled when needed"`
+
+	ContactCellSize int `long:"contact-cell-size" default:"160" description:"size of thumbnail cells in .contact-sheet.jpg in pixels"`
+
+	ContactColumns int `long:"contact-columns" default:"6" description:"number of columns in .contact-sheet.jpg"`
+
+	ContactCaptions bool `long:"contact-captions" description:"draw file names under thumbnails in .contact-sheet.jpg"`
+
+	Daemon bool `long:"daemon" description:"run in background, exits once the mount is ready"`
+
+	PidFile string `long:"pidfile" description:"file to write the pid of the serving process, defaults to one derived from mount point in daemon mode"`
+
+	LogFile string `long:"log-file" description:"file to write logs, logs are discarded in daemon mode if not set"`
+
 	ShowVersion bool `long:"version" description:"print version"`
 
 	FsInfo struct {
-		MountPoint string
+		MountPoint string `required:"yes"`
 		Url        string
-	} `positional-args:"yes" required:"yes" description:"mount point and crawling url"`
+	} `positional-args:"yes" description:"mount point and optional crawling url, sites can be added by mkdir in mount root"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "unmount" {
+		os.Exit(unmountMain(os.Args[2:]))
+	}
+
 	args := make([]string, len(os.Args)-1)
 	copy(args, os.Args[1:])
 
@@ -32,7 +109,10 @@ func main() {
 			return
 		}
 		fmt.Println(err)
-		return
+		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+			return
+		}
+		os.Exit(1)
 	}
 
 	if opts.ShowVersion {
@@ -43,6 +123,102 @@ func main() {
 	fsOpts := viewer.NewOptions()
 	fsOpts.Headless = opts.Headless
 	fsOpts.DriverPort = opts.DriverPort
+	fsOpts.NumberPrefix = opts.NumberPrefix
+	fsOpts.CacheSize = opts.CacheSize << 20
+	fsOpts.CacheStatsInterval = opts.CacheStatsInterval
+	fsOpts.CacheDir = opts.CacheDir
+	fsOpts.DirTTL = opts.DirTTL
+	fsOpts.EntryTimeout = opts.EntryTimeout
+	fsOpts.AttrTimeout = opts.AttrTimeout
+	fsOpts.NegativeTimeout = opts.NegativeTimeout
+	fsOpts.Uid = opts.Uid
+	fsOpts.Gid = opts.Gid
+	for _, hostTTL := range opts.HostTTL {
+		fields := strings.SplitN(hostTTL, "=", 2)
+		if len(fields) != 2 {
+			fmt.Printf("invalid host ttl: %s\n", hostTTL)
+			os.Exit(1)
+		}
+		ttl, err := time.ParseDuration(fields[1])
+		if err != nil {
+			fmt.Printf("invalid host ttl: %s\n", hostTTL)
+			os.Exit(1)
+		}
+		fsOpts.HostTTL[fields[0]] = ttl
+	}
+	fsOpts.ShutdownTimeout = opts.ShutdownTimeout
+	fsOpts.AllowOther = opts.AllowOther
+	fsOpts.FsName = opts.FsName
+	fsOpts.Debug = opts.Debug
+	fsOpts.ReadOnly = opts.ReadOnly
+	fsOpts.PrefetchDepth = opts.PrefetchDepth
+	fsOpts.PrefetchPages = opts.PrefetchPages
+	fsOpts.PrefetchRate = opts.PrefetchRate << 10
+	fsOpts.StreamSize = opts.StreamSize << 10
+	fsOpts.StreamReadAhead = opts.StreamReadAhead
+	fsOpts.ThumbSize = opts.ThumbSize
+	fsOpts.ThumbQuality = opts.ThumbQuality
+	fsOpts.JpegQuality = opts.JpegQuality
+	fsOpts.ArchiveDepth = opts.ArchiveDepth
+	fsOpts.ContactCellSize = opts.ContactCellSize
+	fsOpts.ContactColumns = opts.ContactColumns
+	fsOpts.ContactCaptions = opts.ContactCaptions
+	fsOpts.Scope = opts.Scope
+	fsOpts.Depth = opts.Depth
+	if opts.SitesConfig != "" {
+		sites, err := viewer.LoadSitesConfig(opts.SitesConfig, fsOpts)
+		if err != nil {
+			fmt.Printf("load sites config with error: %s\n", err)
+			os.Exit(1)
+		}
+		fsOpts.Sites = append(fsOpts.Sites, sites...)
+	}
+	for _, value := range opts.Sites {
+		site, err := viewer.ParseSite(value, fsOpts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fsOpts.Sites = append(fsOpts.Sites, site)
+	}
+
+	pidfile := opts.PidFile
+	if pidfile == "" && (opts.Daemon || isDaemonChild()) {
+		pidfile = defaultPidFile(opts.FsInfo.MountPoint)
+	}
+	if pid, alive := readPidFile(pidfile); alive && pid != os.Getpid() {
+		fmt.Printf("image_tool is already running with pid %d\n", pid)
+		os.Exit(1)
+	}
 
+	if opts.Daemon && !isDaemonChild() {
+		if err := startDaemon(opts.LogFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.LogFile != "" {
+		f, err := os.OpenFile(opts.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Printf("open log file with error: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
+	fsOpts.OnReady = func() {
+		if pidfile != "" {
+			if err := writePidFile(pidfile); err != nil {
+				log.Printf("write pid file with error: %s", err)
+			}
+		}
+		notifyReady()
+	}
 	viewer.Serve(opts.FsInfo.MountPoint, opts.FsInfo.Url, fsOpts)
+	if pidfile != "" {
+		os.Remove(pidfile)
+	}
 }
@@ -0,0 +1,382 @@
+// Virtual archives of images in every crawled directory, generated while
+// they are read
+
+package viewer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+const (
+	// zip archive of images in the directory, stored without compression
+	ZipFileName = ".archive.zip"
+
+	// tar archive of images in the directory
+	TarFileName = ".archive.tar"
+)
+
+var archiveFileNames = []string{ZipFileName, TarFileName}
+
+func isArchiveFileName(name string) bool {
+	return name == ZipFileName || name == TarFileName
+}
+
+// archiveEntries returns archives listed in a crawled directory
+func archiveEntries() []fuse.DirEntry {
+	entries := make([]fuse.DirEntry, 0, len(archiveFileNames))
+	for _, name := range archiveFileNames {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+	}
+	return entries
+}
+
+// archiveEntry is an image in an archive
+type archiveEntry struct {
+	// path in the archive, relative to the archived directory
+	name string
+
+	file  *fileNode
+	size  int64
+	mtime time.Time
+}
+
+// archiveNode is the archive name of images in directory dir
+type archiveNode struct {
+	baseNode
+
+	dir  *dirNode
+	name string
+}
+
+func (fs *ImageFs) newArchiveNode(d *dirNode, name string) *archiveNode {
+	return &archiveNode{
+		baseNode: newBaseNode(fs, filepath.Join(d.path, name)),
+		dir:      d,
+		name:     name,
+	}
+}
+
+// entries collects images in the directory and its sub directories up to
+// Options.ArchiveDepth levels, sub directories not crawled yet are crawled
+// if crawl is set, otherwise they are skipped
+func (n *archiveNode) entries(crawl bool) []archiveEntry {
+	entries := make([]archiveEntry, 0)
+	n.dir.collectArchive("", n.fs.Options.ArchiveDepth, crawl, &entries)
+	return entries
+}
+
+func (d *dirNode) collectArchive(prefix string, depth int, crawl bool, entries *[]archiveEntry) {
+	fs := d.fs
+	fs.mu.RLock()
+	link, crawled := d.url, d.entries != nil
+	fs.mu.RUnlock()
+	if !crawled {
+		if link == "" || !crawl {
+			return
+		}
+		if _, err := d.loadForeground(link); err != nil {
+			log.Printf("get data from src with error: %s", err)
+			return
+		}
+	}
+
+	fs.mu.RLock()
+	names := make([]string, 0)
+	subDirs := make([]*dirNode, 0)
+	for _, entry := range d.entries.ToDirEntries() {
+		switch child := d.children[entry.Name].(type) {
+		case *fileNode:
+			*entries = append(*entries, archiveEntry{
+				name:  path.Join(prefix, entry.Name),
+				file:  child,
+				size:  int64(child.attr.Size),
+				mtime: time.Unix(int64(child.attr.Mtime), 0),
+			})
+		case *dirNode:
+			if depth > 0 {
+				names = append(names, entry.Name)
+				subDirs = append(subDirs, child)
+			}
+		}
+	}
+	fs.mu.RUnlock()
+	for i, sub := range subDirs {
+		sub.collectArchive(path.Join(prefix, names[i]), depth-1, crawl, entries)
+	}
+}
+
+func zipHeader(e archiveEntry) *zip.FileHeader {
+	return &zip.FileHeader{Name: e.name, Method: zip.Store, Modified: e.mtime}
+}
+
+func tarHeader(e archiveEntry) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeReg, Name: e.name, Mode: 0644, Size: e.size, ModTime: e.mtime}
+}
+
+// writeArchive writes entries to w in the format of archive name, content
+// returns data of an entry, which must be of the size of the entry
+func writeArchive(w io.Writer, name string, entries []archiveEntry, content func(archiveEntry) (io.Reader, error)) error {
+	copyEntry := func(dst io.Writer, e archiveEntry) error {
+		r, err := content(e)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, r)
+		return err
+	}
+	if name == ZipFileName {
+		zw := zip.NewWriter(w)
+		for _, e := range entries {
+			fw, err := zw.CreateHeader(zipHeader(e))
+			if err != nil {
+				return err
+			}
+			if err := copyEntry(fw, e); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if err := tw.WriteHeader(tarHeader(e)); err != nil {
+			return err
+		}
+		if err := copyEntry(tw, e); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// archiveSize returns the size of archive name of entries, it is computed
+// from sizes of entries and their headers without generating the archive
+func archiveSize(name string, entries []archiveEntry) (int64, error) {
+	if name == ZipFileName {
+		return zipSize(entries), nil
+	}
+	return tarSize(entries)
+}
+
+// zipSize follows the layout archive/zip writes for stored entries with
+// modification time: local header, data and data descriptor of every
+// entry, then the central directory and end records. Zip64 fields are
+// added once sizes or offsets reach 4GB.
+func zipSize(entries []archiveEntry) int64 {
+	const (
+		max32 = 1<<32 - 1
+
+		// extended timestamp extra field
+		timeExtraLen = 9
+	)
+	var offset, dirSize int64
+	zip64 := false
+	for _, e := range entries {
+		nameLen := int64(len(e.name))
+		var zip64Extra int64
+		if e.size >= max32 {
+			// compressed and uncompressed sizes
+			zip64Extra += 16
+		}
+		if offset >= max32 {
+			zip64Extra += 8
+		}
+		if zip64Extra > 0 {
+			zip64 = true
+			zip64Extra += 4
+		}
+		dirSize += 46 + nameLen + timeExtraLen + zip64Extra
+
+		descriptorLen := int64(16)
+		if e.size > max32 {
+			descriptorLen = 24
+		}
+		offset += 30 + nameLen + timeExtraLen + e.size + descriptorLen
+	}
+	size := offset + dirSize + 22
+	if zip64 || len(entries) >= 1<<16-1 || dirSize >= max32 || offset >= max32 {
+		// zip64 end of central directory record and locator
+		size += 56 + 20
+	}
+	return size
+}
+
+// tarSize sums headers and data padded to blocks of entries, headers are
+// encoded alone to count long names and large sizes stored in pax records
+func tarSize(entries []archiveEntry) (int64, error) {
+	const blockSize = 512
+	w := &countWriter{}
+	for _, e := range entries {
+		if err := tar.NewWriter(w).WriteHeader(tarHeader(e)); err != nil {
+			return 0, err
+		}
+		w.n += (e.size + blockSize - 1) / blockSize * blockSize
+	}
+	// two zero blocks end the archive
+	return w.n + 2*blockSize, nil
+}
+
+// content returns data of an image in the archive, it fails if the size
+// of the image differs from the size listed when the archive is opened
+func (n *archiveNode) content(e archiveEntry) (io.Reader, error) {
+	data, code := n.fs.fileData(e.file)
+	if !code.Ok() {
+		return nil, fmt.Errorf("get data of %s with error: %s", e.file.path, code)
+	}
+	if int64(len(data)) != e.size {
+		return nil, fmt.Errorf("size of %s changes from %d to %d", e.file.path, e.size, len(data))
+	}
+	return bytes.NewReader(data), nil
+}
+
+// attr returns attributes of the archive of entries
+func (n *archiveNode) attr(entries []archiveEntry) (fuse.Attr, fuse.Status) {
+	size, err := archiveSize(n.name, entries)
+	if err != nil {
+		log.Printf("compute size of %s with error: %s", n.path, err)
+		return fuse.Attr{}, fuse.EIO
+	}
+	n.fs.mu.RLock()
+	mtime := time.Unix(int64(n.dir.attr.Mtime), 0)
+	n.fs.mu.RUnlock()
+	return n.fs.newAttr(n.path, fuse.S_IFREG|0444, uint64(size), mtime), fuse.OK
+}
+
+// GetAttr reports the size of the archive of crawled directories only,
+// the archive may grow when it is opened and sub directories are crawled
+func (n *archiveNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	if f, ok := file.(*archiveFile); ok {
+		*out = f.attr
+		return fuse.OK
+	}
+	attr, code := n.attr(n.entries(false))
+	if code.Ok() {
+		*out = attr
+	}
+	return code
+}
+
+func (n *archiveNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	log.Printf("Open name: %s", n.path)
+	if isWriteFlags(flags) {
+		if n.fs.readOnly() {
+			return nil, erofs
+		}
+		return nil, fuse.EPERM
+	}
+	entries := n.entries(true)
+	attr, code := n.attr(entries)
+	if !code.Ok() {
+		return nil, code
+	}
+	file := &archiveFile{File: nodefs.NewDefaultFile(), node: n, entries: entries, attr: attr}
+	// the size may differ from the one reported before crawling
+	return &nodefs.WithFlags{File: file, FuseFlags: fuse.FOPEN_DIRECT_IO}, fuse.OK
+}
+
+// archiveFile generates the archive of entries snapshotted at open while
+// it is read, images are fetched one by one as the archive goes. Reads are
+// expected to be sequential, reading backwards generates the archive again
+// from the beginning.
+type archiveFile struct {
+	nodefs.File
+
+	node    *archiveNode
+	entries []archiveEntry
+	attr    fuse.Attr
+
+	mu sync.Mutex
+
+	// generated archive and the offset read from it, nil until first read
+	reader *io.PipeReader
+	pos    int64
+}
+
+func (f *archiveFile) String() string {
+	return "archiveFile(" + f.node.path + ")"
+}
+
+// restart generates the archive from the beginning
+func (f *archiveFile) restart() {
+	if f.reader != nil {
+		// the writing goroutine fails and exits
+		f.reader.Close()
+	}
+	r, w := io.Pipe()
+	size := int64(f.attr.Size)
+	go func() {
+		count := &countWriter{}
+		err := writeArchive(io.MultiWriter(w, count), f.node.name, f.entries, f.node.content)
+		if err == nil && count.n != size {
+			err = fmt.Errorf("archive size %d differs from computed size %d", count.n, size)
+		}
+		w.CloseWithError(err)
+	}()
+	f.reader, f.pos = r, 0
+}
+
+func (f *archiveFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	size := int64(f.attr.Size)
+	if off >= size {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	if f.reader == nil || off < f.pos {
+		f.restart()
+	}
+	if off > f.pos {
+		skipped, err := io.CopyN(ioutil.Discard, f.reader, off-f.pos)
+		f.pos += skipped
+		if err != nil {
+			log.Printf("read %s at %d with error: %s", f.node.path, off, err)
+			return nil, fuse.EIO
+		}
+	}
+	if int64(len(buf)) > size-off {
+		buf = buf[:size-off]
+	}
+	n, err := io.ReadFull(f.reader, buf)
+	f.pos += int64(n)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Printf("read %s at %d with error: %s", f.node.path, off, err)
+		return nil, fuse.EIO
+	}
+	return fuse.ReadResultData(buf[:n]), fuse.OK
+}
+
+func (f *archiveFile) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+	}
+}
+
+func (f *archiveFile) GetAttr(out *fuse.Attr) fuse.Status {
+	*out = f.attr
+	return fuse.OK
+}
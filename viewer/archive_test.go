@@ -0,0 +1,135 @@
+package viewer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testArchiveEntries(sizes ...int64) []archiveEntry {
+	entries := make([]archiveEntry, 0, len(sizes))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, size := range sizes {
+		entries = append(entries, archiveEntry{name: fmt.Sprintf("%03d.jpg", i), size: size, mtime: mtime})
+	}
+	return entries
+}
+
+func testArchiveContent(e archiveEntry) (io.Reader, error) {
+	return bytes.NewReader(bytes.Repeat([]byte{byte(e.size)}, int(e.size))), nil
+}
+
+func TestArchiveSize(t *testing.T) {
+	many := make([]int64, 50)
+	for i := range many {
+		many[i] = int64(i * 37)
+	}
+	named := testArchiveEntries(10, 20, 30, 40)
+	named[0].name = "sub/dir/图片.png"
+	named[1].name = strings.Repeat("long", 40) + ".jpg"
+	named[2].name = strings.Repeat("d/", 60) + "deep.gif"
+	named[3].name = ""
+	cases := []struct {
+		desc    string
+		entries []archiveEntry
+	}{
+		{"empty", testArchiveEntries()},
+		{"one", testArchiveEntries(1000)},
+		{"empty file", testArchiveEntries(0)},
+		{"block sizes", testArchiveEntries(511, 512, 513)},
+		{"many", testArchiveEntries(many...)},
+		{"names", named},
+	}
+	for _, c := range cases {
+		for _, name := range archiveFileNames {
+			size, err := archiveSize(name, c.entries)
+			if err != nil {
+				t.Errorf("%s %s: compute size: %s", c.desc, name, err)
+				continue
+			}
+			var buf bytes.Buffer
+			if err := writeArchive(&buf, name, c.entries, testArchiveContent); err != nil {
+				t.Errorf("%s %s: write: %s", c.desc, name, err)
+				continue
+			}
+			if size != int64(buf.Len()) {
+				t.Errorf("%s %s: computed size %d, written %d", c.desc, name, size, buf.Len())
+			}
+			if got := readArchiveNames(t, name, buf.Bytes()); len(got) != len(c.entries) {
+				t.Errorf("%s %s: read %d entries, want %d", c.desc, name, len(got), len(c.entries))
+			}
+		}
+	}
+}
+
+// readArchiveNames returns names of entries in archive data, checking
+// their content on the way
+func readArchiveNames(t *testing.T, name string, data []byte) []string {
+	names := make([]string, 0)
+	if name == ZipFileName {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Errorf("read zip: %s", err)
+			return names
+		}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Errorf("open %s in zip: %s", f.Name, err)
+				continue
+			}
+			if n, err := io.Copy(ioutil.Discard, r); err != nil || uint64(n) != f.UncompressedSize64 {
+				t.Errorf("read %s in zip: %d bytes, %v", f.Name, n, err)
+			}
+			r.Close()
+			names = append(names, f.Name)
+		}
+		return names
+	}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		} else if err != nil {
+			t.Errorf("read tar: %s", err)
+			return names
+		}
+		if n, err := io.Copy(ioutil.Discard, tr); err != nil || n != hdr.Size {
+			t.Errorf("read %s in tar: %d bytes, %v", hdr.Name, n, err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+// a changed image either fails writing or gives an archive not of the
+// computed size, which is reported as an error when reading
+func TestWriteArchiveSizeMismatch(t *testing.T) {
+	entries := testArchiveEntries(100)
+	contents := map[string]func(archiveEntry) (io.Reader, error){
+		"shorter": func(e archiveEntry) (io.Reader, error) {
+			return bytes.NewReader(make([]byte, e.size-1)), nil
+		},
+		"longer": func(e archiveEntry) (io.Reader, error) {
+			return bytes.NewReader(make([]byte, e.size+1)), nil
+		},
+	}
+	for _, name := range archiveFileNames {
+		size, err := archiveSize(name, entries)
+		if err != nil {
+			t.Fatalf("%s: compute size: %s", name, err)
+		}
+		for desc, content := range contents {
+			var buf bytes.Buffer
+			if err := writeArchive(&buf, name, entries, content); err == nil && size == int64(buf.Len()) {
+				t.Errorf("%s with %s content: size mismatch is not detected", name, desc)
+			}
+		}
+	}
+}
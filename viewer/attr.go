@@ -0,0 +1,63 @@
+package viewer
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// preferred io size reported to stat, st_blocks is always in 512 bytes
+const blockSize = 4096
+
+// inodeNumber derives a stable inode number from the full path of a file,
+// so inode numbers stay the same across remounts
+func inodeNumber(path string) uint64 {
+	if path == "" || path == "/" {
+		return fuse.FUSE_ROOT_ID
+	}
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	ino := h.Sum64()
+	// 0 is invalid and 1 is reserved for root
+	if ino <= fuse.FUSE_ROOT_ID {
+		ino += 2
+	}
+	return ino
+}
+
+// owner returns the configured owner of all files, defaults to the
+// mounting user
+func (fs *ImageFs) owner() fuse.Owner {
+	owner := *fuse.CurrentOwner()
+	if fs.Options.Uid >= 0 {
+		owner.Uid = uint32(fs.Options.Uid)
+	}
+	if fs.Options.Gid >= 0 {
+		owner.Gid = uint32(fs.Options.Gid)
+	}
+	return owner
+}
+
+// newAttr builds attributes of the file at path, ctime is the time the
+// attributes are created
+func (fs *ImageFs) newAttr(path string, mode uint32, size uint64, mtime time.Time) fuse.Attr {
+	now := uint64(time.Now().Unix())
+	attr := fuse.Attr{
+		Ino:   inodeNumber(path),
+		Mode:  mode,
+		Size:  size,
+		Atime: now,
+		Mtime: uint64(mtime.Unix()),
+		Ctime: now,
+		Owner: fs.owner(),
+	}
+	setBlksize(&attr, blockSize)
+	attr.Blocks = (size + 511) / 512
+	if mode&fuse.S_IFDIR != 0 {
+		attr.Nlink = 2
+	} else {
+		attr.Nlink = 1
+	}
+	return attr
+}
@@ -0,0 +1,9 @@
+package viewer
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func setBlksize(attr *fuse.Attr, size uint32) {
+	attr.Blksize = size
+}
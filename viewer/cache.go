@@ -0,0 +1,122 @@
+// Memory bounded content cache with LRU eviction
+
+package viewer
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// number of cached files and their total size in bytes
+	Entries int
+	Bytes   int64
+
+	// configured byte budget, 0 means unlimited
+	Budget int64
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("hits=%d misses=%d evictions=%d entries=%d bytes=%d budget=%d",
+		s.Hits, s.Misses, s.Evictions, s.Entries, s.Bytes, s.Budget)
+}
+
+type cacheEntry struct {
+	key  string
+	data FileData
+}
+
+// ContentCache keeps file data in memory up to a byte budget, the least
+// recently used files are evicted first when the budget is exceeded.
+type ContentCache struct {
+	mu sync.Mutex
+
+	budget int64
+	size   int64
+
+	// front of lru is the most recently used entry
+	lru   *list.List
+	items map[string]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// NewContentCache creates a cache holding at most budget bytes, a budget
+// not greater than zero means unlimited.
+func NewContentCache(budget int64) *ContentCache {
+	if budget < 0 {
+		budget = 0
+	}
+	return &ContentCache{
+		budget: budget,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+func (c *ContentCache) Get(key string) (FileData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.hits++
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).data, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// Put adds or replaces data of key. Data larger than the whole budget is
+// not cached at all.
+func (c *ContentCache) Put(key string, data FileData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+	if c.budget > 0 && int64(len(data)) > c.budget {
+		return
+	}
+	c.items[key] = c.lru.PushFront(&cacheEntry{key: key, data: data})
+	c.size += int64(len(data))
+	for c.budget > 0 && c.size > c.budget {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.remove(oldest.Value.(*cacheEntry).key)
+		c.evictions++
+	}
+}
+
+func (c *ContentCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+func (c *ContentCache) remove(key string) {
+	if elem, ok := c.items[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.items, key)
+		c.size -= int64(len(elem.Value.(*cacheEntry).data))
+	}
+}
+
+func (c *ContentCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.items),
+		Bytes:     c.size,
+		Budget:    c.budget,
+	}
+}
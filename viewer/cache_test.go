@@ -0,0 +1,147 @@
+package viewer
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestContentCache(t *testing.T) {
+	type op struct {
+		// "put", "get" or "remove"
+		name string
+		key  string
+		size int
+	}
+	cases := []struct {
+		desc      string
+		budget    int64
+		ops       []op
+		keys      []string
+		bytes     int64
+		evictions uint64
+	}{
+		{
+			desc:   "unlimited",
+			budget: 0,
+			ops:    []op{{"put", "a", 100}, {"put", "b", 200}, {"put", "c", 300}},
+			keys:   []string{"a", "b", "c"},
+			bytes:  600,
+		},
+		{
+			desc:   "negative budget is unlimited",
+			budget: -1,
+			ops:    []op{{"put", "a", 100}, {"put", "b", 200}},
+			keys:   []string{"a", "b"},
+			bytes:  300,
+		},
+		{
+			desc:      "oldest is evicted",
+			budget:    10,
+			ops:       []op{{"put", "a", 4}, {"put", "b", 4}, {"put", "c", 4}},
+			keys:      []string{"b", "c"},
+			bytes:     8,
+			evictions: 1,
+		},
+		{
+			desc:      "get makes an entry recently used",
+			budget:    10,
+			ops:       []op{{"put", "a", 4}, {"put", "b", 4}, {"get", "a", 0}, {"put", "c", 4}},
+			keys:      []string{"a", "c"},
+			bytes:     8,
+			evictions: 1,
+		},
+		{
+			desc:      "several entries are evicted for a large one",
+			budget:    10,
+			ops:       []op{{"put", "a", 3}, {"put", "b", 3}, {"put", "c", 3}, {"put", "d", 9}},
+			keys:      []string{"d"},
+			bytes:     9,
+			evictions: 3,
+		},
+		{
+			desc:   "data filling the budget is cached",
+			budget: 10,
+			ops:    []op{{"put", "a", 10}},
+			keys:   []string{"a"},
+			bytes:  10,
+		},
+		{
+			desc:   "data over the budget is not cached and evicts nothing",
+			budget: 10,
+			ops:    []op{{"put", "a", 4}, {"put", "b", 11}},
+			keys:   []string{"a"},
+			bytes:  4,
+		},
+		{
+			desc:   "data over the budget drops the old data of the key",
+			budget: 10,
+			ops:    []op{{"put", "a", 4}, {"put", "a", 11}},
+			keys:   []string{},
+			bytes:  0,
+		},
+		{
+			desc:   "replacing counts the new size only",
+			budget: 10,
+			ops:    []op{{"put", "a", 4}, {"put", "b", 4}, {"put", "a", 6}},
+			keys:   []string{"a", "b"},
+			bytes:  10,
+		},
+		{
+			desc:   "removed entries free their size",
+			budget: 10,
+			ops:    []op{{"put", "a", 4}, {"put", "b", 4}, {"remove", "a", 0}, {"remove", "x", 0}, {"put", "c", 6}},
+			keys:   []string{"b", "c"},
+			bytes:  10,
+		},
+	}
+	for _, c := range cases {
+		cache := NewContentCache(c.budget)
+		for _, op := range c.ops {
+			switch op.name {
+			case "put":
+				cache.Put(op.key, make(FileData, op.size))
+			case "get":
+				cache.Get(op.key)
+			case "remove":
+				cache.Remove(op.key)
+			}
+		}
+		stats := cache.Stats()
+		keys := make([]string, 0)
+		for key := range cache.items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) != len(c.keys) || stats.Entries != len(c.keys) {
+			t.Errorf("%s: cached %v, want %v", c.desc, keys, c.keys)
+		} else {
+			for i := range keys {
+				if keys[i] != c.keys[i] {
+					t.Errorf("%s: cached %v, want %v", c.desc, keys, c.keys)
+					break
+				}
+			}
+		}
+		if stats.Bytes != c.bytes {
+			t.Errorf("%s: cached %d bytes, want %d", c.desc, stats.Bytes, c.bytes)
+		}
+		if stats.Evictions != c.evictions {
+			t.Errorf("%s: %d evictions, want %d", c.desc, stats.Evictions, c.evictions)
+		}
+	}
+}
+
+func TestContentCacheStats(t *testing.T) {
+	cache := NewContentCache(100)
+	cache.Put("a", FileData("data"))
+	if data, ok := cache.Get("a"); !ok || string(data) != "data" {
+		t.Errorf("get a: %q %v, want %q true", data, ok, "data")
+	}
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("get b: found")
+	}
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Budget != 100 {
+		t.Errorf("stats %s, want 1 hit, 1 miss and budget 100", stats)
+	}
+}
@@ -0,0 +1,167 @@
+// Contact sheet tiling thumbnails of all images in a directory
+
+package viewer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// jpeg in every crawled directory tiling thumbnails of its images in a grid
+const ContactSheetFileName = ".contact-sheet.jpg"
+
+const (
+	// space around cells of a contact sheet
+	contactPadding = 8
+
+	// height of the caption under a cell
+	contactCaptionHeight = glyphHeight + 4
+
+	// images decoded at the same time for a contact sheet
+	contactWorkers = 4
+)
+
+var (
+	contactBackground  = color.RGBA{0xf0, 0xf0, 0xf0, 0xff}
+	contactPlaceholder = color.RGBA{0xc0, 0xc0, 0xc0, 0xff}
+	contactCaption     = color.RGBA{0x20, 0x20, 0x20, 0xff}
+)
+
+// contactSheetKey returns the key of the contact sheet of the directory in
+// content cache
+func (d *dirNode) contactSheetKey() string {
+	return filepath.Join(d.path, ContactSheetFileName)
+}
+
+// contactSheet returns the contact sheet of the directory, it is generated
+// on first access from image data and kept in content cache until the
+// directory changes
+func (d *dirNode) contactSheet() (FileData, error) {
+	fs := d.fs
+	key := d.contactSheetKey()
+	if data, ok := fs.Contents.Get(key); ok {
+		return data, nil
+	}
+
+	fs.mu.RLock()
+	names := make([]string, 0)
+	files := make([]*fileNode, 0)
+	if d.entries != nil {
+		for _, entry := range d.entries.ToDirEntries() {
+			if file, ok := d.children[entry.Name].(*fileNode); ok && canConvert(file.meta.ContentType) {
+				names = append(names, entry.Name)
+				files = append(files, file)
+			}
+		}
+	}
+	fs.mu.RUnlock()
+
+	cell := fs.Options.ContactCellSize
+	thumbs := make([]*image.RGBA, len(files))
+	sem := make(chan struct{}, contactWorkers)
+	var wg sync.WaitGroup
+	for i, file := range files {
+		wg.Add(1)
+		go func(i int, file *fileNode) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			data, code := fs.fileData(file)
+			if !code.Ok() {
+				return
+			}
+			img, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				log.Printf("decode %s for contact sheet with error: %s", file.path, err)
+				return
+			}
+			if img.Bounds().Empty() {
+				log.Printf("skip %s for contact sheet: %s", file.path, errEmptyImage)
+				return
+			}
+			thumbs[i] = scaleDown(img, cell)
+		}(i, file)
+	}
+	wg.Wait()
+
+	sheet := drawContactSheet(names, thumbs, cell, fs.Options.ContactColumns, fs.Options.ContactCaptions)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, sheet, &jpeg.Options{Quality: fs.Options.ThumbQuality}); err != nil {
+		return nil, err
+	}
+	data := FileData(buf.Bytes())
+	fs.Contents.Put(key, data)
+	return data, nil
+}
+
+// contactSheetStat returns the size of the contact sheet of the directory
+// if it is generated, otherwise 0, and the time the directory is crawled
+func (d *dirNode) contactSheetStat() (uint64, time.Time, fuse.Status) {
+	d.fs.mu.RLock()
+	page := d.page
+	d.fs.mu.RUnlock()
+	if page == nil {
+		return 0, time.Time{}, fuse.ENOENT
+	}
+	var size uint64
+	if data, ok := d.fs.Contents.Get(d.contactSheetKey()); ok {
+		size = uint64(len(data))
+	}
+	return size, time.Unix(page.FetchedAt, 0), fuse.OK
+}
+
+// drawContactSheet tiles thumbs in a grid of columns, every thumb is
+// centered in a cell x cell square, nil thumbs are drawn as placeholders.
+// Names are drawn under thumbs if captions is set.
+func drawContactSheet(names []string, thumbs []*image.RGBA, cell int, columns int, captions bool) *image.RGBA {
+	if cell <= 0 {
+		cell = 1
+	}
+	if columns <= 0 || columns > len(thumbs) {
+		columns = len(thumbs)
+	}
+	rows := 0
+	if columns > 0 {
+		rows = (len(thumbs) + columns - 1) / columns
+	}
+	cellHeight := cell
+	if captions {
+		cellHeight += contactCaptionHeight
+	}
+	width := columns*(cell+contactPadding) + contactPadding
+	height := rows*(cellHeight+contactPadding) + contactPadding
+	sheet := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(contactBackground), image.Point{}, draw.Src)
+
+	maxChars := cell / glyphAdvance
+	for i, thumb := range thumbs {
+		x := contactPadding + (i%columns)*(cell+contactPadding)
+		y := contactPadding + (i/columns)*(cellHeight+contactPadding)
+		if thumb == nil {
+			rect := image.Rect(x, y, x+cell, y+cell)
+			draw.Draw(sheet, rect, image.NewUniform(contactPlaceholder), image.Point{}, draw.Src)
+		} else {
+			size := thumb.Bounds().Size()
+			at := image.Pt(x+(cell-size.X)/2, y+(cell-size.Y)/2)
+			draw.Draw(sheet, image.Rectangle{Min: at, Max: at.Add(size)}, thumb, image.Point{}, draw.Src)
+		}
+		if captions {
+			caption := []rune(names[i])
+			if len(caption) > maxChars {
+				caption = caption[:maxChars]
+			}
+			cx := x + (cell-len(caption)*glyphAdvance)/2
+			drawText(sheet, cx, y+cell+2, string(caption), contactCaption)
+		}
+	}
+	return sheet
+}
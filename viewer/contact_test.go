@@ -0,0 +1,39 @@
+package viewer
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContactSheetSkipsEmptyImage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><img src="empty.gif"><img src="a.png"></html>`)
+		case "/empty.gif":
+			w.Write(emptyGif)
+		case "/a.png":
+			w.Write(testPngData(4, 3))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	fs := newTestImageFs(srv.URL + "/")
+	defer fs.cancel()
+	if _, err := fs.root.loadForeground(srv.URL + "/"); err != nil {
+		t.Fatalf("crawl %s: %s", srv.URL, err)
+	}
+	data, err := fs.root.contactSheet()
+	if err != nil {
+		t.Fatalf("contact sheet: %s", err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("decode contact sheet: %s", err)
+	}
+}
@@ -0,0 +1,269 @@
+// Control files for refreshing and purging directories inside the mount
+
+package viewer
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+const (
+	// control file in every directory, commands written to it apply to
+	// the directory itself, an empty line means refresh
+	RefreshFileName = ".refresh"
+
+	// control file in mount root, accepts "<command> [path]" lines where
+	// path is relative to mount root
+	ControlFileName = ".control"
+)
+
+const (
+	// crawl the directory again and merge new items
+	cmdRefresh = "refresh"
+
+	// drop cached data of all files under the directory recursively
+	cmdPurge = "purge"
+
+	// forget the whole subtree, it is crawled again on next listing
+	cmdDrop = "drop"
+)
+
+func isWriteFlags(flags uint32) bool {
+	return flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0
+}
+
+// controlEntries returns control files listed in directory name
+func controlEntries(name string) []fuse.DirEntry {
+	entries := []fuse.DirEntry{{Name: RefreshFileName, Mode: fuse.S_IFREG}}
+	if name == "" {
+		entries = append(entries, fuse.DirEntry{Name: ControlFileName, Mode: fuse.S_IFREG})
+	}
+	return entries
+}
+
+// newControlNode creates control file name in directory d
+func (fs *ImageFs) newControlNode(d *dirNode, name string) *specialNode {
+	data := func() (FileData, time.Time, fuse.Status) {
+		return FileData{}, time.Now(), fuse.OK
+	}
+	return fs.newSpecialNode(filepath.Join(d.path, name), 0644, data, fs.runControl(name, d))
+}
+
+// findDir returns the directory at path relative to mount root, ancestors
+// not crawled yet are crawled on the way
+func (fs *ImageFs) findDir(path string) (*dirNode, bool) {
+	d := fs.root
+	if path == "" {
+		return d, true
+	}
+	for _, name := range strings.Split(path, "/") {
+		child, ok := d.child(name).(*dirNode)
+		if !ok && d.resolve(name) {
+			child, ok = d.child(name).(*dirNode)
+		}
+		if !ok {
+			return nil, false
+		}
+		d = child
+	}
+	return d, true
+}
+
+// execControl runs a control command on directory d
+func (fs *ImageFs) execControl(cmd string, d *dirNode) fuse.Status {
+	log.Printf("control %s on dir %s", cmd, d.path)
+	switch cmd {
+	case cmdRefresh:
+		fs.mu.RLock()
+		link := d.url
+		fs.mu.RUnlock()
+		if link == "" {
+			return fuse.ENOENT
+		}
+		if err := d.recrawl(link); err != nil {
+			log.Printf("refresh %s with error: %s", d.path, err)
+			return fuse.EIO
+		}
+	case cmdPurge:
+		d.purge()
+	case cmdDrop:
+		d.drop()
+	default:
+		return fuse.EINVAL
+	}
+	return fuse.OK
+}
+
+// purge drops cached data of all files under the directory, they will be
+// fetched from source again on next open
+func (d *dirNode) purge() {
+	fs := d.fs
+	fs.mu.Lock()
+	purged := make([]*fileNode, 0)
+	d.walk(func(dir *dirNode) {
+		fs.Contents.Remove(dir.contactSheetKey())
+		for _, child := range dir.children {
+			if file, ok := child.(*fileNode); ok {
+				file.blob = ""
+				fs.dropViews(file)
+				purged = append(purged, file)
+			}
+		}
+	})
+	fs.mu.Unlock()
+
+	for _, file := range purged {
+		fs.Contents.Remove(file.path)
+		if fs.conn != nil && file.Inode() != nil {
+			fs.conn.FileNotify(file.Inode(), 0, 0)
+		}
+	}
+	log.Printf("purge dir %s done, %d files purged", d.path, len(purged))
+	fs.saveIndex()
+}
+
+// drop forgets everything under the directory, the directory itself is
+// kept and will be crawled again on next listing
+func (d *dirNode) drop() {
+	names := d.forget()
+	d.fs.invalidate(d, names)
+	log.Printf("drop dir %s done", d.path)
+	d.fs.saveIndex()
+}
+
+// forget removes everything under the directory and returns names of
+// entries that were listed in it, sites are kept when dropping mount root
+func (d *dirNode) forget() []string {
+	fs := d.fs
+	fs.mu.Lock()
+	names := make([]string, 0, len(d.children))
+	for name, child := range d.children {
+		names = append(names, name)
+		fs.dropNode(child)
+	}
+	fs.Contents.Remove(d.contactSheetKey())
+	d.entries = nil
+	d.children = make(map[string]nodefs.Node)
+	d.page = nil
+	d.crawled = time.Time{}
+	fs.mu.Unlock()
+
+	d.detach(names)
+	return names
+}
+
+// dropNode drops cached data of a file, or of all files under a
+// directory, before the node is removed. Caller must hold fs.mu.
+func (fs *ImageFs) dropNode(node nodefs.Node) {
+	switch node := node.(type) {
+	case *fileNode:
+		fs.Contents.Remove(node.path)
+		fs.dropViews(node)
+	case *dirNode:
+		node.walk(func(dir *dirNode) {
+			fs.Contents.Remove(dir.contactSheetKey())
+			for _, child := range dir.children {
+				if file, ok := child.(*fileNode); ok {
+					fs.Contents.Remove(file.path)
+					fs.dropViews(file)
+				}
+			}
+		})
+	}
+}
+
+// controlFile collects data written to a special file and passes it to run
+// when the file is flushed
+type controlFile struct {
+	nodefs.File
+
+	node *specialNode
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	written bool
+}
+
+func newControlFile(node *specialNode) nodefs.File {
+	return &controlFile{
+		File: nodefs.NewDefaultFile(),
+		node: node,
+	}
+}
+
+func (f *controlFile) String() string {
+	return "controlFile"
+}
+
+func (f *controlFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	return fuse.ReadResultData(nil), fuse.OK
+}
+
+func (f *controlFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf.Write(data)
+	f.written = true
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *controlFile) Truncate(size uint64) fuse.Status {
+	return fuse.OK
+}
+
+func (f *controlFile) GetAttr(out *fuse.Attr) fuse.Status {
+	return f.node.GetAttr(out, nil, nil)
+}
+
+// Flush runs data written since last flush
+func (f *controlFile) Flush() fuse.Status {
+	f.mu.Lock()
+	data := f.buf.String()
+	written := f.written
+	f.buf.Reset()
+	f.written = false
+	f.mu.Unlock()
+	if !written {
+		return fuse.OK
+	}
+	return f.node.write(data)
+}
+
+// runControl returns a function running control commands written to
+// control file name in directory d, one command per line
+func (fs *ImageFs) runControl(name string, d *dirNode) func(string) fuse.Status {
+	root := name == ControlFileName
+	return func(data string) fuse.Status {
+		lines := strings.Split(strings.TrimSpace(data), "\n")
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			cmd, target := cmdRefresh, d
+			if len(fields) > 0 {
+				cmd = fields[0]
+			}
+			if root && len(fields) > 1 {
+				path := strings.Trim(filepath.Clean(fields[1]), "/")
+				if path == "." {
+					path = ""
+				}
+				dir, ok := fs.findDir(path)
+				if !ok {
+					return fuse.ENOENT
+				}
+				target = dir
+			}
+			if code := fs.execControl(cmd, target); !code.Ok() {
+				return code
+			}
+		}
+		return fuse.OK
+	}
+}
@@ -0,0 +1,61 @@
+// Views transcoding images to png or jpeg on read
+
+package viewer
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+const (
+	// virtual directory holding every image of a crawled directory as png
+	PngDirName = ".as-png"
+
+	// virtual directory holding every image of a crawled directory as jpeg
+	JpegDirName = ".as-jpeg"
+)
+
+// toPng transcodes image data to png, png data is returned as it is
+func (fs *ImageFs) toPng(data FileData) (FileData, error) {
+	img, fm, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if fm == "png" {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// toJpeg transcodes image data to jpeg with Options.JpegQuality, jpeg data
+// is returned as it is
+func (fs *ImageFs) toJpeg(data FileData) (FileData, error) {
+	img, fm, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if fm == "jpeg" {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: fs.Options.JpegQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// flatten blends img over white, as jpeg has no alpha channel
+func flatten(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	return dst
+}
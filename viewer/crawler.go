@@ -4,18 +4,22 @@ package viewer
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/tebeka/selenium"
-	"github.com/teris-io/shortid"
 )
 
 type DataType uint32
@@ -36,12 +40,37 @@ type CrawData struct {
 	Url  string
 	Type DataType
 	Data []byte
+
+	// position of the element among elements of the same type in the page
+	Index int
+
+	// attributes of img element, empty for sub links
+	Alt   string
+	Class string
+
+	// last modified time reported by server, zero if unknown
+	ModTime time.Time
+
+	// full size of the image, Data only holds the head of it if it is
+	// larger than len(Data), the rest is read with range requests
+	Size int64
 }
 
+// Partial returns whether only the head of the image is downloaded
+func (data *CrawData) Partial() bool {
+	return data.Size > int64(len(data.Data))
+}
+
+// serializes use of headless browsers, loading a page and reading its
+// source must not interleave with other crawls
+var driverMu sync.Mutex
+
 // getHtmlData visits url and returns page source, if headless is true,
 // javascript will also be executed
-func getHtmlData(url string, headless bool, driver selenium.WebDriver) ([]byte, error) {
+func getHtmlData(ctx context.Context, url string, headless bool, driver selenium.WebDriver) ([]byte, error) {
 	if headless {
+		driverMu.Lock()
+		defer driverMu.Unlock()
 		err := driver.Get(url)
 		if err != nil {
 			log.Printf("headless get url with error: %s", err)
@@ -50,7 +79,7 @@ func getHtmlData(url string, headless bool, driver selenium.WebDriver) ([]byte,
 		data, err := driver.PageSource()
 		return []byte(data), err
 	} else {
-		resp, err := http.Get(url)
+		resp, err := httpGet(ctx, url)
 		if err != nil {
 			log.Printf("get url with error: %s\n", err)
 			return nil, err
@@ -62,6 +91,73 @@ func getHtmlData(url string, headless bool, driver selenium.WebDriver) ([]byte,
 	}
 }
 
+// httpGet issues a GET request which is aborted when ctx is canceled, the
+// response body is throttled if ctx carries a rate limiter
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if limiter := limiterFrom(ctx); limiter != nil {
+		resp.Body = &limitedReader{ReadCloser: resp.Body, ctx: ctx, limiter: limiter}
+	}
+	return resp, nil
+}
+
+// fetchImage returns the raw data of an image and its last modified time,
+// src can be either a http url or a base64 data url. The returned time is
+// zero if the server does not provide Last-Modified header.
+func fetchImage(ctx context.Context, src string) ([]byte, time.Time, error) {
+	data, _, modTime, err := fetchImageHead(ctx, src, 0)
+	return data, modTime, err
+}
+
+// size of image head downloaded for detecting image type and dimensions
+const imageHeadSize = 64 << 10
+
+// fetchImageHead works like fetchImage, but if the image is larger than
+// limit and the server supports range requests, only its head is read. It
+// also returns the full size of the image. limit 0 means no limit.
+func fetchImageHead(ctx context.Context, src string, limit int64) ([]byte, int64, time.Time, error) {
+	if strings.HasPrefix(src, "data:image") {
+		i := strings.Index(src, ",")
+		if i < 0 {
+			return nil, 0, time.Time{}, errors.New("invalid base64 image")
+		}
+		reader := base64.NewDecoder(base64.StdEncoding, strings.NewReader(src[i+1:]))
+		buffer := bytes.Buffer{}
+		if _, err := buffer.ReadFrom(reader); err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		return buffer.Bytes(), int64(buffer.Len()), time.Time{}, nil
+	}
+	resp, err := httpGet(ctx, src)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		modTime = time.Time{}
+	}
+	if limit > 0 && resp.ContentLength > limit && resp.Header.Get("Accept-Ranges") == "bytes" {
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, imageHeadSize))
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		return data, resp.ContentLength, modTime, nil
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	return data, int64(len(data)), modTime, nil
+}
+
 var imgRE = regexp.MustCompile(`<img[^>]+\bsrc=["']([^"'><]*?)["']`)
 var hrefRE = regexp.MustCompile(`<a[^>]+\bhref=["']([^"'><]*?)["']`)
 
@@ -124,9 +220,9 @@ func findImages2(htm string) []*ImageInfo {
 func crawSublink(baseUrl string, htm string, c chan<- CrawData, notifyWG *sync.WaitGroup) {
 	var wg sync.WaitGroup
 	baseU, _ := url.Parse(baseUrl)
-	for _, link := range findLinks2(htm) {
+	for idx, link := range findLinks2(htm) {
 		wg.Add(1)
-		go func(src string) {
+		go func(src string, idx int) {
 			defer wg.Done()
 			u, err := url.Parse(src)
 			if err != nil {
@@ -151,20 +247,19 @@ func crawSublink(baseUrl string, htm string, c chan<- CrawData, notifyWG *sync.W
 					strings.TrimPrefix(src, u.Scheme+"://"),
 					"/"),
 				"/", "_", -1)
-			c <- CrawData{name, src, Href, nil}
-		}(link)
+			c <- CrawData{Name: name, Url: src, Type: Href, Index: idx}
+		}(link, idx)
 	}
 	wg.Wait()
 	notifyWG.Done()
 }
 
-func crawlImg(baseUrl string, htm string, c chan<- CrawData, notifyWG *sync.WaitGroup) {
-	sid, _ := shortid.New(1, shortid.DefaultABC, 2342)
+func crawlImg(ctx context.Context, baseUrl string, htm string, streamSize int64, c chan<- CrawData, notifyWG *sync.WaitGroup) {
 	var wg sync.WaitGroup
 	baseU, _ := url.Parse(baseUrl)
-	for _, imgInfo := range findImages2(htm) {
+	for idx, imgInfo := range findImages2(htm) {
 		wg.Add(1)
-		go func(info *ImageInfo) {
+		go func(info *ImageInfo, idx int) {
 			defer wg.Done()
 			src := info.Src
 			u, err := url.Parse(src)
@@ -180,25 +275,19 @@ func crawlImg(baseUrl string, htm string, c chan<- CrawData, notifyWG *sync.Wait
 
 			// ignore base64 image
 			if u.Scheme == "data" && strings.HasPrefix(src, "data:image") {
-				i := strings.Index(src, ",")
-				if i < 0 {
-					log.Printf("invalid base64 image\n")
-				}
-				reader := base64.NewDecoder(base64.StdEncoding, strings.NewReader(src[i+1:]))
-				buffer := bytes.Buffer{}
-				_, err := buffer.ReadFrom(reader)
+				raw, _, err := fetchImage(ctx, src)
 				if err != nil {
 					log.Printf("read from base64 buffer error: %s", err)
 					return
 				}
-				fm, err := DetectImageType(buffer.Bytes())
+				fm, err := DetectImageType(raw)
 				if err != nil {
 					log.Printf("read image config error: %s", err)
 					return
 				}
-				fid := RandomId(sid)
-				filename := info.Class + fid + "." + fm
-				c <- CrawData{filename, src, Image, buffer.Bytes()}
+				filename := info.Class + SourceId(src) + "." + fm
+				c <- CrawData{Name: filename, Url: src, Type: Image, Data: raw, Index: idx,
+					Alt: info.Alt, Class: info.Class, Size: int64(len(raw))}
 				return
 			}
 
@@ -214,29 +303,22 @@ func crawlImg(baseUrl string, htm string, c chan<- CrawData, notifyWG *sync.Wait
 			needExpandExt := false
 			if info.Alt != "" {
 				// Get filename from alt information
-				fid := RandomId(sid)
-				filename = info.Alt + fid
+				filename = info.Alt + SourceId(src)
 				needExpandExt = true
 			} else {
 				// Get filename from last path field
 				subPath := strings.Split(u.Path, "/")
 				filename = subPath[len(subPath)-1]
 				if len(filename) == 0 {
-					filename = RandomId(sid)
+					filename = SourceId(src)
 				}
 			}
 
-			resp, err := http.Get(src)
+			raw, size, modTime, err := fetchImageHead(ctx, src, streamSize)
 			if err != nil {
 				log.Printf("fetch url with error: %s", err)
 				return
 			}
-			defer resp.Body.Close()
-			raw, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("read url data with error: %s", err)
-				return
-			}
 
 			// Complete file extension if needed
 			if needExpandExt {
@@ -246,24 +328,30 @@ func crawlImg(baseUrl string, htm string, c chan<- CrawData, notifyWG *sync.Wait
 				}
 			}
 
-			c <- CrawData{filename, src, Image, raw}
-		}(imgInfo)
+			c <- CrawData{Name: filename, Url: src, Type: Image, Data: raw, Index: idx,
+				Alt: info.Alt, Class: info.Class, ModTime: modTime, Size: size}
+		}(imgInfo, idx)
 	}
 	wg.Wait()
 	notifyWG.Done()
 }
 
-func Crawl(link string, headless bool, driver selenium.WebDriver) ([]CrawData, error) {
-	data, err := getHtmlData(link, headless, driver)
+// Crawl visits link and returns images and sub links found in the page,
+// together with the page source. Pending requests are aborted when ctx is
+// canceled, and the error of ctx is returned then. Images larger than
+// streamSize are not downloaded entirely if the server supports range
+// requests, 0 means always download entirely.
+func Crawl(ctx context.Context, link string, headless bool, driver selenium.WebDriver, streamSize int64) ([]CrawData, []byte, error) {
+	data, err := getHtmlData(ctx, link, headless, driver)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	var wg sync.WaitGroup
 	html := string(data)
 	result := make([]CrawData, 0)
 	resultCh := make(chan CrawData)
 	wg.Add(2)
-	go crawlImg(link, html, resultCh, &wg)
+	go crawlImg(ctx, link, html, streamSize, resultCh, &wg)
 	go crawSublink(link, html, resultCh, &wg)
 	go func() {
 		wg.Wait()
@@ -272,5 +360,18 @@ func Crawl(link string, headless bool, driver selenium.WebDriver) ([]CrawData, e
 	for value := range resultCh {
 		result = append(result, value)
 	}
-	return result, nil
+	// images failed by cancellation are skipped, do not return a page with
+	// them missing
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	// Elements are collected concurrently, restore the page order, images
+	// come first and then the sub links.
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Type != result[j].Type {
+			return result[i].Type < result[j].Type
+		}
+		return result[i].Index < result[j].Index
+	})
+	return result, data, nil
 }
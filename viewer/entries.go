@@ -0,0 +1,45 @@
+package viewer
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// DirEntryList keeps directory entries in the order they were discovered,
+// entries with a duplicated name are ignored.
+type DirEntryList struct {
+	entries []fuse.DirEntry
+	index   map[string]int
+}
+
+func NewDirEntryList() *DirEntryList {
+	return &DirEntryList{
+		entries: make([]fuse.DirEntry, 0),
+		index:   make(map[string]int),
+	}
+}
+
+// Add appends entry to the list, returns false if the name already exists
+func (l *DirEntryList) Add(entry fuse.DirEntry) bool {
+	if _, ok := l.index[entry.Name]; ok {
+		return false
+	}
+	l.index[entry.Name] = len(l.entries)
+	l.entries = append(l.entries, entry)
+	return true
+}
+
+func (l *DirEntryList) Contains(name string) bool {
+	_, ok := l.index[name]
+	return ok
+}
+
+func (l *DirEntryList) Len() int {
+	return len(l.entries)
+}
+
+// ToDirEntries returns a copy of entries in discovery order
+func (l *DirEntryList) ToDirEntries() []fuse.DirEntry {
+	result := make([]fuse.DirEntry, len(l.entries))
+	copy(result, l.entries)
+	return result
+}
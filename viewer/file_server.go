@@ -3,43 +3,63 @@
 package viewer
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"os"
+	"net/url"
+	"os/signal"
 	"path/filepath"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/deckarep/golang-set"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"github.com/tebeka/selenium"
 )
 
 type FileData []byte
-type DirEntrySet mapset.Set
 type DirContents []fuse.DirEntry
 
-type ImageFs struct {
-	pathfs.FileSystem
+// FileMeta is the provenance of a crawled image
+type FileMeta struct {
+	Alt         string
+	Class       string
+	ContentType string
+	Width       int
+	Height      int
+	FetchedAt   int64
+
+	// number of frames of an animated gif or apng, 0 if it is not animated.
+	// It is counted on the head of a streamed image until the image is
+	// fetched entirely, gif frames beyond the head are missed.
+	Frames int
+}
+
+// PageInfo describes the page a directory is crawled from
+type PageInfo struct {
+	Url       string
+	FetchedAt int64
+
+	// page source, it is not persisted and loaded from Blob when needed
+	Html FileData `json:"-"`
 
+	// hash of page source in Store, empty if persistence is disabled
+	Blob string
+}
+
+type ImageFs struct {
 	// mountpoint
 	Root string
 
 	// root url for crawling
 	BaseUrl string
 
-	// mapping from full path of a file to its fuse.Attr, including dir
-	Attrs map[string]fuse.Attr
-
-	// mapping from full path of a file to its data, excluding dir
-	Contents map[string]FileData
-
-	// mapping from full path of a directory to all file entries under it
-	Entries map[string]DirEntrySet
+	// cached data of files keyed by full path, excluding dir
+	Contents *ContentCache
 
-	// mapping from dir name to real url
-	Urls map[string]string
+	// optional disk store, nil if persistence is disabled
+	Store *Store
 
 	// extra options
 	Options *Options
@@ -49,142 +69,588 @@ type ImageFs struct {
 
 	// headless browser client
 	WebDriver selenium.WebDriver
-}
 
-func ToDirEntries(set DirEntrySet) []fuse.DirEntry {
-	it := set.Iterator()
-	result := make([]fuse.DirEntry, 0)
-	for elem := range it.C {
-		result = append(result, elem.(fuse.DirEntry))
-	}
-	return result
+	// mount root, crawled from BaseUrl
+	root *dirNode
+
+	// mapping from name of top-level crawl roots to their directories, sites
+	// are configured at startup or created by mkdir in mount root
+	sites map[string]*dirNode
+
+	// protects sites and state of all nodes
+	mu sync.RWMutex
+
+	// serializes writing index, so an older snapshot never overwrites a
+	// newer one
+	saveMu sync.Mutex
+
+	// pending write of index scheduled by saveIndex, guarded by pendingMu
+	pendingMu sync.Mutex
+	saveTimer *time.Timer
+
+	// connector serving the node tree, used for kernel notification
+	conn *nodefs.FileSystemConnector
+
+	// number of crawls waited by the user, prefetch pauses while it is not 0
+	foreground int32
+
+	// nil if prefetch is disabled
+	prefetch *prefetcher
+
+	// canceled on shutdown to abort in-flight crawls
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func (fs *ImageFs) fullpath(src string, base string) string {
-	if base == "" && src == fs.Root {
-		return "/"
-	} else {
-		return filepath.Join(base, src)
+// crawl visits link of the directory with options of the site it belongs
+// to, sub links out of the site scope or depth are filtered out
+func (d *dirNode) crawl(ctx context.Context, link string) ([]CrawData, []byte, error) {
+	fs := d.fs
+	fs.mu.RLock()
+	site := *d.top.site
+	depth := d.depth
+	fs.mu.RUnlock()
+
+	headless := site.Headless
+	if headless && fs.WebDriver == nil {
+		log.Printf("headless browser is not started, crawl %s without it", link)
+		headless = false
+	}
+	crawlData, html, err := Crawl(ctx, link, headless, fs.WebDriver, fs.Options.StreamSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := make([]CrawData, 0, len(crawlData))
+	for _, data := range crawlData {
+		if data.Type == Href && !site.allowLink(data.Url, depth) {
+			continue
+		}
+		result = append(result, data)
 	}
+	return result, html, nil
 }
 
-// getData accesses to given url and returns images data and all hrefs
-func (fs *ImageFs) getData(link string, base string) (DirContents, error) {
-	crawlData, err := Crawl(link, fs.Options.Headless, fs.WebDriver)
+// getData accesses to given url and returns images data and all hrefs,
+// nothing is merged or saved if the crawl fails or is canceled
+func (d *dirNode) getData(ctx context.Context, link string) (DirContents, error) {
+	crawlData, html, err := d.crawl(ctx, link)
 	if err != nil {
 		return nil, err
 	}
-	fixBase := base
-	if base == "" {
-		fixBase = "/"
+	entries, _, _ := d.mergeData(link, html, crawlData)
+	d.fs.saveIndex()
+	return entries, nil
+}
+
+// load crawls the directory if it is not crawled yet and returns its
+// entries, concurrent loads of the same directory share one crawl
+func (d *dirNode) load(ctx context.Context, link string) (DirContents, error) {
+	fs := d.fs
+	for {
+		fs.mu.Lock()
+		if d.entries != nil {
+			entries := d.entries.ToDirEntries()
+			fs.mu.Unlock()
+			return entries, nil
+		}
+		if wait := d.loading; wait != nil {
+			fs.mu.Unlock()
+			// the other load may fail or be canceled, then try again
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		done := make(chan struct{})
+		d.loading = done
+		fs.mu.Unlock()
+
+		entries, err := d.getData(ctx, link)
+		fs.mu.Lock()
+		d.loading = nil
+		fs.mu.Unlock()
+		close(done)
+		return entries, err
 	}
-	fs.Entries[fixBase] = mapset.NewSet()
-	for _, data := range crawlData {
-		fullpath := fs.fullpath(data.Name, base)
+}
+
+// mergeData replaces entries of the directory with crawled data of link,
+// entries no longer in the page are dropped. It returns all entries of the
+// directory, names of entries which are new or changed, and names of
+// entries which are removed.
+func (d *dirNode) mergeData(link string, html []byte, crawlData []CrawData) (DirContents, []string, []string) {
+	fs := d.fs
+	page := &PageInfo{Url: link, FetchedAt: time.Now().Unix(), Html: html}
+
+	// write blobs before taking the lock, disk io may be slow
+	blobs := make(map[int]string)
+	if fs.Store != nil {
+		if hash, err := fs.Store.PutBlob(html); err == nil {
+			page.Blob = hash
+		} else {
+			log.Printf("store page source of %s with error: %s", link, err)
+		}
+		for i, data := range crawlData {
+			if data.Type != Image || data.Partial() {
+				continue
+			}
+			hash, err := fs.Store.PutBlob(data.Data)
+			if err != nil {
+				log.Printf("store blob of %s with error: %s", data.Url, err)
+				continue
+			}
+			blobs[i] = hash
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entries := NewDirEntryList()
+	d.page = page
+	changed := make([]string, 0)
+	now := time.Now()
+	width := positionWidth(crawlData)
+	for i, data := range crawlData {
+		if data.Type == Image && fs.Options.NumberPrefix {
+			data.Name = fmt.Sprintf("%0*d_%s", width, data.Index+1, data.Name)
+		}
+		if _, ok := fs.sites[data.Name]; ok && d.path == "" {
+			// sites shadow entries of mount root, they would share paths
+			log.Printf("skip %s in mount root, a site has the name", data.Name)
+			continue
+		}
 		if data.Type == Image {
-			fs.Attrs[fullpath] = fuse.Attr{
-				Mode:  fuse.S_IFREG | 0644,
-				Size:  uint64(len(data.Data)),
-				Atime: uint64(time.Now().Unix()),
-				Mtime: uint64(time.Now().Unix()),
-				Ctime: uint64(time.Now().Unix()),
-			}
-			fs.Contents[fullpath] = data.Data
-			fs.Entries[fixBase].Add(
-				fuse.DirEntry{Name: data.Name, Mode: fuse.S_IFREG})
+			// the first element wins if names are duplicated in the page
+			if !entries.Add(fuse.DirEntry{Name: data.Name, Mode: fuse.S_IFREG}) {
+				continue
+			}
+			file, ok := d.children[data.Name].(*fileNode)
+			if !ok {
+				if child, found := d.children[data.Name]; found {
+					fs.dropNode(child)
+				}
+				file = fs.newFileNode(d, data.Name)
+				d.children[data.Name] = file
+			}
+			if !data.Partial() {
+				fs.Contents.Put(file.path, data.Data)
+			}
+			contentType, width, height := ImageConfig(data.Data)
+			frames := countFrames(data.Data)
+			if data.Partial() && ok && file.src == data.Url && file.meta.Frames > frames {
+				// counted on the whole image after it is fetched, the head
+				// may not hold all frames
+				frames = file.meta.Frames
+			}
+			file.meta = FileMeta{
+				Alt:         data.Alt,
+				Class:       data.Class,
+				ContentType: contentType,
+				Width:       width,
+				Height:      height,
+				FetchedAt:   page.FetchedAt,
+				Frames:      frames,
+			}
+			if hash, ok := blobs[i]; ok {
+				file.blob = hash
+			}
+			if ok && file.src == data.Url && file.attr.Size == uint64(data.Size) {
+				continue
+			}
+			fs.dropViews(file)
+			if data.Partial() {
+				// drop data of the old image, the new one is streamed
+				fs.Contents.Remove(file.path)
+				file.blob = ""
+			}
+			mtime := data.ModTime
+			if mtime.IsZero() {
+				mtime = now
+			}
+			file.attr = fs.newAttr(file.path, fuse.S_IFREG|0644, uint64(data.Size), mtime)
+			file.src = data.Url
+			changed = append(changed, data.Name)
 		} else if data.Type == Href {
 			// ignore self redirect url
 			if data.Url == link {
 				continue
 			}
-			fs.Attrs[fullpath] = fuse.Attr{
-				Mode:  fuse.S_IFDIR | 0755,
-				Atime: uint64(time.Now().Unix()),
-				Mtime: uint64(time.Now().Unix()),
-				Ctime: uint64(time.Now().Unix()),
+			if !entries.Add(fuse.DirEntry{Name: data.Name, Mode: fuse.S_IFDIR}) {
+				continue
+			}
+			if child, ok := d.children[data.Name].(*dirNode); ok {
+				child.url = data.Url
+				continue
+			}
+			if child, found := d.children[data.Name]; found {
+				fs.dropNode(child)
+			}
+			d.children[data.Name] = fs.newDirNode(d, data.Name, data.Url, now)
+			changed = append(changed, data.Name)
+		}
+	}
+	removed := make([]string, 0)
+	for name, child := range d.children {
+		if !entries.Contains(name) {
+			fs.dropNode(child)
+			delete(d.children, name)
+			removed = append(removed, name)
+		}
+	}
+	d.entries = entries
+	d.crawled = time.Now()
+	if len(changed) > 0 || len(removed) > 0 {
+		fs.Contents.Remove(d.contactSheetKey())
+		d.attr.Mtime = uint64(now.Unix())
+		d.attr.Ctime = uint64(now.Unix())
+	}
+	return d.entries.ToDirEntries(), changed, removed
+}
+
+// dirTTL returns how long the listing of a directory crawled from link
+// stays fresh, 0 means forever
+func (fs *ImageFs) dirTTL(link string) time.Duration {
+	if u, err := url.Parse(link); err == nil {
+		if ttl, ok := fs.Options.HostTTL[u.Host]; ok {
+			return ttl
+		}
+	}
+	return fs.Options.DirTTL
+}
+
+// refresh crawls link again in background and merges new items into the
+// directory, only one refresh of a directory runs at the same time
+func (d *dirNode) refresh(link string) {
+	fs := d.fs
+	fs.mu.Lock()
+	if d.refreshing {
+		fs.mu.Unlock()
+		return
+	}
+	d.refreshing = true
+	fs.mu.Unlock()
+
+	go func() {
+		defer func() {
+			fs.mu.Lock()
+			d.refreshing = false
+			fs.mu.Unlock()
+		}()
+		log.Printf("refresh stale dir %s from %s", indexKey(d.path), link)
+		if err := d.recrawl(link); err != nil {
+			log.Printf("refresh %s with error: %s", indexKey(d.path), err)
+		}
+	}()
+}
+
+// recrawl crawls link again and merges new items into the directory,
+// kernel caches of changed entries are invalidated
+func (d *dirNode) recrawl(link string) error {
+	crawlData, html, err := d.crawl(d.fs.ctx, link)
+	if err != nil {
+		return err
+	}
+	_, changed, removed := d.mergeData(link, html, crawlData)
+	log.Printf("refresh dir %s done, %d entries changed, %d removed", d.path, len(changed), len(removed))
+	d.detach(removed)
+	if len(changed) > 0 || len(removed) > 0 {
+		names := append(changed, removed...)
+		d.fs.invalidate(d, append(names, ContactSheetFileName))
+	}
+	d.fs.saveIndex()
+	return nil
+}
+
+// invalidate makes the kernel drop cached dentries, attributes and data of
+// the given entries in directory d, as well as the attributes of d.
+// It must not be called with fs.mu held.
+func (fs *ImageFs) invalidate(d *dirNode, names []string) {
+	if fs.conn == nil || d.Inode() == nil {
+		return
+	}
+	for _, name := range names {
+		if code := fs.conn.EntryNotify(d.Inode(), name); !code.Ok() && code != fuse.ENOENT {
+			log.Printf("entry notify %s in %s with error: %s", name, d.path, code)
+		}
+		// ENOENT means the kernel has not looked up the inode yet
+		if child := d.Inode().GetChild(name); child != nil {
+			if code := fs.conn.FileNotify(child, 0, 0); !code.Ok() && code != fuse.ENOENT {
+				log.Printf("file notify %s in %s with error: %s", name, d.path, code)
+			}
+		}
+	}
+	fs.invalidateViews(d, names)
+	if code := fs.conn.FileNotify(d.Inode(), 0, 0); !code.Ok() && code != fuse.ENOENT {
+		log.Printf("file notify dir %s with error: %s", d.path, code)
+	}
+}
+
+// walk calls fn on directory d and all directories under it, sites are
+// not visited from mount root. Caller must hold fs.mu.
+func (d *dirNode) walk(fn func(dir *dirNode)) {
+	fn(d)
+	for _, child := range d.children {
+		if dir, ok := child.(*dirNode); ok {
+			dir.walk(fn)
+		}
+	}
+}
+
+// walkAll calls fn on all directories including sites, caller must hold
+// fs.mu
+func (fs *ImageFs) walkAll(fn func(dir *dirNode)) {
+	fs.root.walk(fn)
+	for _, site := range fs.sites {
+		site.walk(fn)
+	}
+}
+
+// snapshotIndex builds persistent index from current state, caller must
+// hold fs.mu
+func (fs *ImageFs) snapshotIndex() *Index {
+	idx := NewIndex(fs.BaseUrl)
+	fs.walkAll(func(d *dirNode) {
+		key := indexKey(d.path)
+		idx.Attrs[key] = d.attr
+		if d.path != "" && d.url != "" {
+			idx.Urls[key] = d.url
+		}
+		if d.isSite() {
+			idx.Sites[d.path] = d.site
+		}
+		if d.entries != nil {
+			idx.Entries[key] = d.entries.ToDirEntries()
+			idx.Crawled[key] = d.crawled.Unix()
+		}
+		if d.page != nil {
+			idx.Pages[key] = d.page
+		}
+		for _, child := range d.children {
+			file, ok := child.(*fileNode)
+			if !ok {
+				continue
+			}
+			idx.Attrs[file.path] = file.attr
+			idx.Sources[file.path] = file.src
+			idx.Meta[file.path] = file.meta
+			if file.blob != "" {
+				idx.Blobs[file.path] = file.blob
+			}
+			for _, v := range views {
+				if hash, ok := file.views[v.name]; ok {
+					idx.Blobs[v.filePath(file)] = hash
+				}
 			}
-			fs.Entries[fixBase].Add(
-				fuse.DirEntry{Name: data.Name, Mode: fuse.S_IFDIR})
-			fs.Urls[data.Name] = data.Url
 		}
+	})
+	return idx
+}
+
+// changes to the tree are written to index together after this delay, so
+// crawling many pages in a row does not rewrite the whole index every time
+const indexSaveDelay = 5 * time.Second
+
+// saveIndex schedules writing current state to disk store if it is enabled
+func (fs *ImageFs) saveIndex() {
+	if fs.Store == nil {
+		return
+	}
+	fs.pendingMu.Lock()
+	defer fs.pendingMu.Unlock()
+	if fs.saveTimer == nil {
+		fs.saveTimer = time.AfterFunc(indexSaveDelay, fs.flushIndex)
 	}
-	return ToDirEntries(fs.Entries[fixBase]), nil
 }
 
-func (fs *ImageFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	// log.Printf("GetAttr name: %s", name)
-	if name == "" {
-		name = "/"
+// flushIndex writes current state to disk store now if it is enabled, a
+// pending write is canceled
+func (fs *ImageFs) flushIndex() {
+	if fs.Store == nil {
+		return
 	}
-	if attr, ok := fs.Attrs[name]; ok {
-		return &attr, fuse.OK
-	} else if name == "/" {
-		attr := fuse.Attr{
-			Mode:  fuse.S_IFDIR | 0755,
-			Ctime: uint64(time.Now().Unix()),
+	fs.pendingMu.Lock()
+	if fs.saveTimer != nil {
+		fs.saveTimer.Stop()
+		fs.saveTimer = nil
+	}
+	fs.pendingMu.Unlock()
+
+	fs.saveMu.Lock()
+	defer fs.saveMu.Unlock()
+	fs.mu.RLock()
+	idx := fs.snapshotIndex()
+	fs.mu.RUnlock()
+	if err := fs.Store.SaveIndex(idx); err != nil {
+		log.Printf("save index with error: %s", err)
+	}
+}
+
+// restoreIndex loads a previously saved tree, directories in it will not
+// be crawled again until they are refreshed
+func (fs *ImageFs) restoreIndex(idx *Index) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.restoreDir(idx, fs.root)
+	for name, site := range idx.Sites {
+		if _, ok := fs.root.children[name]; ok {
+			log.Printf("skip site %s in index, it has the name of an entry in mount root", name)
+			continue
 		}
-		fs.Attrs[name] = attr
-		return &attr, fuse.OK
-	} else {
-		return nil, fuse.ENOENT
+		d := fs.newDirNode(nil, name, site.Url, time.Now())
+		d.site = site
+		fs.restoreDir(idx, d)
+		fs.sites[name] = d
 	}
 }
 
-func (fs *ImageFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirEntry, code fuse.Status) {
-	log.Printf("OpenDir name: %s", name)
-	fixName := name
-	if name == "" {
-		fixName = "/"
+// restoreDir loads directory d and everything under it from idx, caller
+// must hold fs.mu
+func (fs *ImageFs) restoreDir(idx *Index, d *dirNode) {
+	key := indexKey(d.path)
+	if attr, ok := idx.Attrs[key]; ok {
+		d.attr = attr
 	}
-	if entry, ok := fs.Entries[fixName]; ok {
-		return ToDirEntries(entry), fuse.OK
-	} else {
-		var link string
-		if name == "" {
-			link = fs.BaseUrl
-		} else {
-			fields := strings.Split(name, string(os.PathSeparator))
-			dirname := fields[len(fields)-1]
-			var tok bool
-			if link, tok = fs.Urls[dirname]; !tok {
-				// should not here
-				log.Printf("url not found for %s", dirname)
-				return nil, fuse.ENOENT
+	if page, ok := idx.Pages[key]; ok {
+		d.page = page
+	}
+	entries, ok := idx.Entries[key]
+	if !ok {
+		return
+	}
+	d.entries = NewDirEntryList()
+	d.crawled = time.Unix(idx.Crawled[key], 0)
+	for _, entry := range entries {
+		d.entries.Add(entry)
+		path := filepath.Join(d.path, entry.Name)
+		if entry.Mode&fuse.S_IFDIR != 0 {
+			child := fs.newDirNode(d, entry.Name, idx.Urls[path], time.Now())
+			if attr, ok := idx.Attrs[path]; ok {
+				child.attr = attr
 			}
+			fs.restoreDir(idx, child)
+			d.children[entry.Name] = child
+			continue
 		}
-		entries, err := fs.getData(link, name)
-		if err != nil {
-			log.Printf("get data from src with error: %s", err)
-		} else {
-			return entries, fuse.OK
+		file := fs.newFileNode(d, entry.Name)
+		file.attr = idx.Attrs[path]
+		file.src = idx.Sources[path]
+		file.blob = idx.Blobs[path]
+		file.meta = idx.Meta[path]
+		file.views = restoreViews(idx, file)
+		d.children[entry.Name] = file
+	}
+}
+
+// positionWidth returns the number of digits needed by the largest image
+// position in crawlData
+func positionWidth(crawlData []CrawData) int {
+	maxPos := 0
+	for _, data := range crawlData {
+		if data.Type == Image && data.Index+1 > maxPos {
+			maxPos = data.Index + 1
 		}
 	}
-	return nil, fuse.ENOENT
+	return len(strconv.Itoa(maxPos))
 }
 
-func (fs *ImageFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	log.Printf("Open name: %s", name)
-	if data, ok := fs.Contents[name]; ok {
-		return nodefs.NewDataFile(data), fuse.OK
-	} else {
-		return nil, fuse.ENOENT
+// statFs reports the content cache budget as total size and cached bytes as
+// used size, every known file or directory takes one inode. With unlimited
+// cache budget the file system is reported as full.
+func (fs *ImageFs) statFs() *fuse.StatfsOut {
+	stats := fs.Contents.Stats()
+	used := (uint64(stats.Bytes) + blockSize - 1) / blockSize
+	total := used
+	if stats.Budget > 0 {
+		total = uint64(stats.Budget) / blockSize
+		if total < used {
+			total = used
+		}
+	}
+	var files uint64
+	fs.mu.RLock()
+	fs.walkAll(func(d *dirNode) {
+		files += 1 + uint64(len(d.children))
+	})
+	fs.mu.RUnlock()
+	return &fuse.StatfsOut{
+		Blocks:  total,
+		Bfree:   total - used,
+		Bavail:  total - used,
+		Files:   files,
+		Ffree:   0,
+		Bsize:   blockSize,
+		Frsize:  blockSize,
+		NameLen: 255,
+	}
+}
+
+// logCacheStats prints content cache statistics every interval
+func (fs *ImageFs) logCacheStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		log.Printf("content cache stats: %s", fs.Contents.Stats())
 	}
 }
 
 func Serve(root string, baseUrl string, opts *Options) {
-	fs := ImageFs{
-		FileSystem: pathfs.NewDefaultFileSystem(),
-		Root:       root,
-		BaseUrl:    baseUrl,
-		Attrs:      make(map[string]fuse.Attr),
-		Contents:   make(map[string]FileData),
-		Entries:    make(map[string]DirEntrySet),
-		Urls:       make(map[string]string),
-		Options:    opts,
-	}
-
-	nfs := pathfs.NewPathNodeFs(&fs, nil)
-	server, _, err := nodefs.MountRoot(root, nfs.Root(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs := &ImageFs{
+		Root:     root,
+		BaseUrl:  baseUrl,
+		Contents: NewContentCache(opts.CacheSize),
+		sites:    make(map[string]*dirNode),
+		Options:  opts,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	fs.root = fs.newDirNode(nil, "", baseUrl, time.Now())
+	fs.root.site = NewSite("", baseUrl, opts)
+	if opts.PrefetchDepth > 0 && opts.PrefetchPages > 0 {
+		fs.prefetch = newPrefetcher(fs)
+	}
+
+	if opts.CacheDir != "" {
+		store, err := NewStore(opts.CacheDir)
+		if err != nil {
+			log.Fatalf("Open cache dir fail: %v\n", err)
+		}
+		idx, err := store.LoadIndex(baseUrl)
+		if err != nil {
+			log.Printf("load index with error, start from scratch: %s", err)
+		} else {
+			fs.restoreIndex(idx)
+		}
+		fs.Store = store
+	}
+
+	for _, site := range opts.Sites {
+		if err := fs.addSite(site); err != nil {
+			log.Printf("add site with error: %s", err)
+		}
+	}
+
+	mountOpts := nodefs.NewOptions()
+	mountOpts.EntryTimeout = opts.EntryTimeout
+	mountOpts.AttrTimeout = opts.AttrTimeout
+	mountOpts.NegativeTimeout = opts.NegativeTimeout
+	owner := fs.owner()
+	mountOpts.Owner = &owner
+	mountOpts.Debug = opts.Debug
+	conn := nodefs.NewFileSystemConnector(fs.root, mountOpts)
+	fuseOpts := &fuse.MountOptions{
+		AllowOther: opts.AllowOther,
+		FsName:     opts.FsName,
+		Name:       "image_viewer",
+		Debug:      opts.Debug,
+	}
+	if opts.ReadOnly {
+		fuseOpts.Options = append(fuseOpts.Options, "ro")
+	}
+	sigCh := notifyShutdown()
+	defer signal.Stop(sigCh)
+	server, err := fuse.NewServer(conn.RawFS(), root, fuseOpts)
 	if err != nil {
 		log.Fatalf("Mount fail: %v\n", err)
 	}
@@ -192,7 +658,7 @@ func Serve(root string, baseUrl string, opts *Options) {
 	var driverSrv *selenium.Service
 	var webDriver selenium.WebDriver
 
-	if opts.Headless {
+	if opts.NeedHeadless() {
 		var err error
 		driverSrv, webDriver, err = StartChrome(fs.Options.DriverPort)
 		if err != nil {
@@ -200,6 +666,7 @@ func Serve(root string, baseUrl string, opts *Options) {
 			if driverSrv != nil {
 				driverSrv.Stop()
 			}
+			unmount(server, root, opts.ShutdownTimeout)
 			return
 		}
 		fs.DriverSrv = driverSrv
@@ -212,6 +679,27 @@ func Serve(root string, baseUrl string, opts *Options) {
 		defer webDriver.Quit()
 	}
 
+	if opts.CacheStatsInterval > 0 {
+		go fs.logCacheStats(opts.CacheStatsInterval)
+	}
+
+	serveDone := make(chan struct{})
+	go func() {
+		server.Serve()
+		close(serveDone)
+	}()
+	if err := server.WaitMount(); err != nil {
+		log.Printf("wait mount with error: %s", err)
+		fs.cancel()
+		unmount(server, root, opts.ShutdownTimeout)
+		return
+	}
+
 	log.Printf("fileserver starts now...\n")
-	server.Serve()
+	if opts.OnReady != nil {
+		opts.OnReady()
+	}
+	fs.serveUntilSignal(server, serveDone, sigCh)
+	fs.flushIndex()
+	log.Printf("fileserver stopped\n")
 }
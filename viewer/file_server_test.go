@@ -0,0 +1,59 @@
+package viewer
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// newTestImageFs creates a file system crawling baseUrl with sites, it is
+// served by a connector but not mounted
+func newTestImageFs(baseUrl string, sites ...*Site) *ImageFs {
+	opts := NewOptions()
+	ctx, cancel := context.WithCancel(context.Background())
+	fs := &ImageFs{
+		BaseUrl:  baseUrl,
+		Contents: NewContentCache(opts.CacheSize),
+		sites:    make(map[string]*dirNode),
+		Options:  opts,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	fs.root = fs.newDirNode(nil, "", baseUrl, time.Now())
+	fs.root.site = NewSite("", baseUrl, opts)
+	for _, site := range sites {
+		fs.addSite(site)
+	}
+	nodefs.NewFileSystemConnector(fs.root, nodefs.NewOptions())
+	return fs
+}
+
+func TestSaveIndexIsDelayed(t *testing.T) {
+	fs := newTestImageFs("http://example.com/")
+	defer fs.cancel()
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("new store: %s", err)
+	}
+	fs.Store = store
+
+	for i := 0; i < 10; i++ {
+		fs.saveIndex()
+	}
+	if _, err := os.Stat(store.indexPath(fs.BaseUrl)); !os.IsNotExist(err) {
+		t.Errorf("index is written before %s", indexSaveDelay)
+	}
+	fs.flushIndex()
+	if _, err := os.Stat(store.indexPath(fs.BaseUrl)); err != nil {
+		t.Errorf("index is not written after flush: %s", err)
+	}
+	fs.pendingMu.Lock()
+	pending := fs.saveTimer != nil
+	fs.pendingMu.Unlock()
+	if pending {
+		t.Errorf("write of index is still pending after flush")
+	}
+}
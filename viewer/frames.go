@@ -0,0 +1,701 @@
+// Frames of animated gif and apng images extracted into virtual
+// directories next to the images
+
+package viewer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+const (
+	// suffix of the virtual directory holding frames of an animated image
+	FramesDirSuffix = ".frames"
+
+	// manifest of frames in every frames directory
+	FramesManifestName = "frames.json"
+)
+
+type FrameInfo struct {
+	Name    string `json:"name"`
+	Index   int    `json:"index"`
+	DelayMs int64  `json:"delay_ms"`
+}
+
+type FramesManifest struct {
+	Source string `json:"source"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+
+	// how many times the animation plays, 0 means forever
+	LoopCount int `json:"loop_count"`
+
+	Frames []FrameInfo `json:"frames"`
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// animations larger than these are not decoded, sizes in headers are not
+// trusted and every frame is composed on a canvas of the full size
+const (
+	maxCanvasPixels = 4096 * 4096
+	maxFrames       = 1000
+)
+
+// countFrames returns the number of frames of an animated gif or apng, 0
+// if data is neither of them. Frames are counted without decoding, if data
+// is only the head of an image the count of gif frames is a lower bound.
+func countFrames(data []byte) int {
+	if bytes.HasPrefix(data, pngSignature) {
+		chunks, _ := readPngChunks(data)
+		for _, chunk := range chunks {
+			if chunk.typ == "acTL" && len(chunk.data) >= 8 {
+				return int(binary.BigEndian.Uint32(chunk.data))
+			}
+			if chunk.typ == "IDAT" {
+				break
+			}
+		}
+		return 0
+	}
+	if !isGif(data) {
+		return 0
+	}
+	_, blocks := splitGif(data)
+	return len(blocks)
+}
+
+func isGif(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+}
+
+// splitGif splits gif data into the header, which is the logical screen
+// descriptor with the global color table, and blocks of frames. A block is
+// the extensions preceding an image and the image, the last block may be
+// truncated.
+func splitGif(data []byte) ([]byte, [][]byte) {
+	blocks := make([][]byte, 0)
+	if len(data) < 13 {
+		return nil, blocks
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (uint(data[10]&7) + 1)
+	}
+	if pos > len(data) {
+		return nil, blocks
+	}
+	header := data[:pos]
+	start := pos
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			// extension label followed by data sub blocks
+			pos = skipSubBlocks(data, pos+2)
+		case 0x2c:
+			// image descriptor, local color table, lzw code size and
+			// image data sub blocks
+			if pos+10 > len(data) {
+				return header, append(blocks, data[start:])
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (uint(flags&7) + 1)
+			}
+			pos = skipSubBlocks(data, pos+1)
+			blocks = append(blocks, data[start:pos])
+			start = pos
+		default:
+			// trailer or garbage
+			return header, blocks
+		}
+	}
+	return header, blocks
+}
+
+func skipSubBlocks(data []byte, pos int) int {
+	for pos < len(data) {
+		n := int(data[pos])
+		pos++
+		if n == 0 {
+			return pos
+		}
+		pos += n
+	}
+	return len(data)
+}
+
+// animation describes an animated image decoded frame by frame
+type animation struct {
+	width, height int
+	loopCount     int
+
+	// delays of all frames
+	delays []time.Duration
+}
+
+// frameFunc receives frame index composed on the full canvas, the canvas is
+// changed for the next frame after it returns. Returning errStopFrames
+// stops decoding.
+type frameFunc func(index int, canvas *image.RGBA, delay time.Duration) error
+
+var errStopFrames = errors.New("stop decoding frames")
+
+// checkAnimation returns an error if an animation is too large to decode
+func checkAnimation(width, height uint64, frames int) error {
+	if width == 0 || height == 0 || width > maxCanvasPixels || height > maxCanvasPixels || width*height > maxCanvasPixels {
+		return fmt.Errorf("canvas of %dx%d is too large", width, height)
+	}
+	if frames > maxFrames {
+		return fmt.Errorf("%d frames are too many", frames)
+	}
+	return nil
+}
+
+// decodeAnimation decodes an animated gif or apng one frame at a time,
+// every frame is passed to fn. On errStopFrames the animation is returned
+// with delays of frames decoded so far.
+func decodeAnimation(data []byte, fn frameFunc) (*animation, error) {
+	var anim *animation
+	var err error
+	if bytes.HasPrefix(data, pngSignature) {
+		anim, err = decodeApng(data, fn)
+	} else {
+		anim, err = decodeGif(data, fn)
+	}
+	if err == errStopFrames {
+		err = nil
+	}
+	return anim, err
+}
+
+// decodeGif rebuilds every frame as a standalone gif with the header of
+// data, so only one frame is decoded at a time
+func decodeGif(data []byte, fn frameFunc) (*animation, error) {
+	if !isGif(data) {
+		return nil, errors.New("not a gif")
+	}
+	header, blocks := splitGif(data)
+	if header == nil || len(blocks) == 0 {
+		return nil, errors.New("gif without frames")
+	}
+	anim := &animation{
+		width:  int(binary.LittleEndian.Uint16(header[6:])),
+		height: int(binary.LittleEndian.Uint16(header[8:])),
+	}
+	if err := checkAnimation(uint64(anim.width), uint64(anim.height), len(blocks)); err != nil {
+		return nil, err
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, anim.width, anim.height))
+	var previous *image.RGBA
+	for i, block := range blocks {
+		var buf bytes.Buffer
+		buf.Write(header)
+		buf.Write(block)
+		buf.WriteByte(0x3b)
+		g, err := gif.DecodeAll(&buf)
+		if err != nil || len(g.Image) != 1 {
+			return nil, fmt.Errorf("decode frame %d with error: %v", i, err)
+		}
+		if i == 0 {
+			// gif loop count is the number of repeats, -1 means playing
+			// once, it is in an extension before the first frame
+			switch {
+			case g.LoopCount < 0:
+				anim.loopCount = 1
+			case g.LoopCount > 0:
+				anim.loopCount = g.LoopCount + 1
+			}
+		}
+		frame := g.Image[0]
+		var disposal byte
+		if len(g.Disposal) > 0 {
+			disposal = g.Disposal[0]
+		}
+		if disposal == gif.DisposalPrevious {
+			if previous == nil {
+				previous = image.NewRGBA(canvas.Rect)
+			}
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		delay := time.Duration(0)
+		if len(g.Delay) > 0 {
+			delay = time.Duration(g.Delay[0]) * 10 * time.Millisecond
+		}
+		anim.delays = append(anim.delays, delay)
+		if err := fn(i, canvas, delay); err != nil {
+			return anim, err
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous.Pix)
+		}
+	}
+	return anim, nil
+}
+
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// readPngChunks splits png data into chunks, crc is not checked
+func readPngChunks(data []byte) ([]pngChunk, error) {
+	chunks := make([]pngChunk, 0)
+	data = data[len(pngSignature):]
+	for len(data) >= 12 {
+		n := binary.BigEndian.Uint32(data)
+		if int64(n) > int64(len(data)-12) {
+			return chunks, errors.New("truncated png chunk")
+		}
+		chunk := pngChunk{typ: string(data[4:8]), data: data[8 : 8+n]}
+		chunks = append(chunks, chunk)
+		data = data[12+n:]
+		if chunk.typ == "IEND" {
+			break
+		}
+	}
+	return chunks, nil
+}
+
+func writePngChunk(buf *bytes.Buffer, typ string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.WriteString(typ)
+	buf.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+type apngFrame struct {
+	// frame control chunk and image data of the frame
+	fctl []byte
+	data []byte
+}
+
+// decodeApng decodes an apng, every frame is rebuilt as a standalone png
+// and decoded with image/png before it is composed on the canvas
+func decodeApng(data []byte, fn frameFunc) (*animation, error) {
+	chunks, err := readPngChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	var ihdr []byte
+	anim := &animation{}
+	// chunks before image data shared by all frames, such as palette
+	shared := make([]pngChunk, 0)
+	frames := make([]*apngFrame, 0)
+	var current *apngFrame
+	seenData := false
+	for _, chunk := range chunks {
+		switch chunk.typ {
+		case "IHDR":
+			ihdr = chunk.data
+		case "acTL":
+			if len(chunk.data) >= 8 {
+				anim.loopCount = int(binary.BigEndian.Uint32(chunk.data[4:]))
+			}
+		case "fcTL":
+			if len(chunk.data) < 26 {
+				return nil, errors.New("invalid apng frame control")
+			}
+			current = &apngFrame{fctl: chunk.data}
+			frames = append(frames, current)
+		case "IDAT":
+			// the default image is the first frame only if a frame
+			// control precedes it
+			seenData = true
+			if current != nil {
+				current.data = append(current.data, chunk.data...)
+			}
+		case "fdAT":
+			if current != nil && len(chunk.data) >= 4 {
+				current.data = append(current.data, chunk.data[4:]...)
+			}
+		case "IEND":
+		default:
+			if !seenData {
+				shared = append(shared, chunk)
+			}
+		}
+	}
+	if len(ihdr) != 13 || len(frames) == 0 {
+		return nil, errors.New("not an animated png")
+	}
+
+	canvasWidth, canvasHeight := binary.BigEndian.Uint32(ihdr), binary.BigEndian.Uint32(ihdr[4:])
+	if err := checkAnimation(uint64(canvasWidth), uint64(canvasHeight), len(frames)); err != nil {
+		return nil, err
+	}
+	anim.width, anim.height = int(canvasWidth), int(canvasHeight)
+	canvas := image.NewRGBA(image.Rect(0, 0, anim.width, anim.height))
+	var previous *image.RGBA
+	for i, frame := range frames {
+		fctl := frame.fctl
+		width, height := binary.BigEndian.Uint32(fctl[4:]), binary.BigEndian.Uint32(fctl[8:])
+		x, y := binary.BigEndian.Uint32(fctl[12:]), binary.BigEndian.Uint32(fctl[16:])
+		delayNum, delayDen := binary.BigEndian.Uint16(fctl[20:]), binary.BigEndian.Uint16(fctl[22:])
+		dispose, blend := fctl[24], fctl[25]
+		if uint64(x)+uint64(width) > uint64(canvasWidth) || uint64(y)+uint64(height) > uint64(canvasHeight) {
+			return nil, fmt.Errorf("frame %d is out of the canvas", i)
+		}
+
+		var buf bytes.Buffer
+		buf.Write(pngSignature)
+		header := make([]byte, 13)
+		binary.BigEndian.PutUint32(header, width)
+		binary.BigEndian.PutUint32(header[4:], height)
+		copy(header[8:], ihdr[8:])
+		writePngChunk(&buf, "IHDR", header)
+		for _, chunk := range shared {
+			writePngChunk(&buf, chunk.typ, chunk.data)
+		}
+		writePngChunk(&buf, "IDAT", frame.data)
+		writePngChunk(&buf, "IEND", nil)
+		img, err := png.Decode(&buf)
+		if err != nil {
+			return nil, fmt.Errorf("decode frame %d with error: %s", i, err)
+		}
+
+		// disposing to previous on the first frame means clearing
+		if dispose == 2 && i == 0 {
+			dispose = 1
+		}
+		if dispose == 2 {
+			if previous == nil {
+				previous = image.NewRGBA(canvas.Rect)
+			}
+			copy(previous.Pix, canvas.Pix)
+		}
+		rect := image.Rect(int(x), int(y), int(x+width), int(y+height))
+		op := draw.Over
+		if blend == 0 {
+			op = draw.Src
+		}
+		draw.Draw(canvas, rect, img, img.Bounds().Min, op)
+		if delayDen == 0 {
+			delayDen = 100
+		}
+		delay := time.Duration(delayNum) * time.Second / time.Duration(delayDen)
+		anim.delays = append(anim.delays, delay)
+		if err := fn(i, canvas, delay); err != nil {
+			return anim, err
+		}
+		switch dispose {
+		case 1:
+			draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+		case 2:
+			copy(canvas.Pix, previous.Pix)
+		}
+	}
+	return anim, nil
+}
+
+// framesDirName returns the name of the frames directory of image name
+func framesDirName(name string) string {
+	return name + FramesDirSuffix
+}
+
+// framesEntries returns frames directories of animated images in the
+// directory
+func (d *dirNode) framesEntries() []fuse.DirEntry {
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+	entries := make([]fuse.DirEntry, 0)
+	if d.entries == nil {
+		return entries
+	}
+	for _, entry := range d.entries.ToDirEntries() {
+		if file, ok := d.children[entry.Name].(*fileNode); ok && file.meta.Frames > 1 {
+			entries = append(entries, fuse.DirEntry{Name: framesDirName(entry.Name), Mode: fuse.S_IFDIR})
+		}
+	}
+	return entries
+}
+
+// framesChild returns the frames directory name in the directory, caller
+// must hold fs.mu
+func (d *dirNode) framesChild(name string) *framesNode {
+	if !strings.HasSuffix(name, FramesDirSuffix) {
+		return nil
+	}
+	file, ok := d.children[strings.TrimSuffix(name, FramesDirSuffix)].(*fileNode)
+	if !ok || file.meta.Frames <= 1 {
+		return nil
+	}
+	return file.framesDir
+}
+
+// framesNode is the virtual directory holding frames of an animated image
+// as png, named with their position and delay, and a manifest of them
+type framesNode struct {
+	baseNode
+
+	file *fileNode
+
+	// the manifest, and frames by name created on first lookup, so lookups
+	// keep their inodes. frames are dropped with cached frames when the
+	// image changes, guarded by fs.mu
+	manifest *specialNode
+	frames   map[string]*specialNode
+}
+
+func (fs *ImageFs) newFramesNode(file *fileNode) *framesNode {
+	n := &framesNode{
+		baseNode: newBaseNode(fs, file.path+FramesDirSuffix),
+		file:     file,
+	}
+	data := func() (FileData, time.Time, fuse.Status) {
+		content, code := fs.manifestData(file)
+		return content, n.mtime(), code
+	}
+	n.manifest = fs.newSpecialNode(filepath.Join(n.path, FramesManifestName), 0444, data, nil)
+	return n
+}
+
+// frameNode returns the node of frame name, it is created on first call
+func (n *framesNode) frameNode(name string) *specialNode {
+	fs := n.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if node, ok := n.frames[name]; ok {
+		return node
+	}
+	path := filepath.Join(n.path, name)
+	data := func() (FileData, time.Time, fuse.Status) {
+		content, code := fs.frameData(n.file, name)
+		return content, n.mtime(), code
+	}
+	node := fs.newSpecialNode(path, 0444, data, nil)
+	// a frame evicted from cache is extracted again with frames after it,
+	// listing frames must not do it
+	node.stat = func() (uint64, time.Time, fuse.Status) {
+		var size uint64
+		if data, ok := fs.Contents.Get(path); ok {
+			size = uint64(len(data))
+		}
+		return size, n.mtime(), fuse.OK
+	}
+	if n.frames == nil {
+		n.frames = make(map[string]*specialNode)
+	}
+	n.frames[name] = node
+	return node
+}
+
+func (n *framesNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	n.fs.mu.RLock()
+	mtime := time.Unix(int64(n.file.attr.Mtime), 0)
+	n.fs.mu.RUnlock()
+	*out = n.fs.newAttr(n.path, fuse.S_IFDIR|0555, 0, mtime)
+	return fuse.OK
+}
+
+func (n *framesNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	log.Printf("OpenDir name: %s", n.path)
+	manifest, code := n.fs.framesManifest(n.file)
+	if !code.Ok() {
+		return nil, code
+	}
+	entries := make([]fuse.DirEntry, 0, len(manifest.Frames)+1)
+	for _, frame := range manifest.Frames {
+		entries = append(entries, fuse.DirEntry{Name: frame.Name, Mode: fuse.S_IFREG})
+	}
+	return append(entries, fuse.DirEntry{Name: FramesManifestName, Mode: fuse.S_IFREG}), fuse.OK
+}
+
+func (n *framesNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	fs := n.fs
+	child := n.manifest
+	if name != FramesManifestName {
+		manifest, code := fs.framesManifest(n.file)
+		if !code.Ok() {
+			return nil, code
+		}
+		found := false
+		for _, frame := range manifest.Frames {
+			found = found || frame.Name == name
+		}
+		if !found {
+			return nil, fuse.ENOENT
+		}
+		child = n.frameNode(name)
+	}
+	if code := child.GetAttr(out, nil, context); !code.Ok() {
+		return nil, code
+	}
+	return fs.attachNode(n.Inode(), name, child), fuse.OK
+}
+
+func (n *framesNode) mtime() time.Time {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+	return time.Unix(int64(n.file.attr.Mtime), 0)
+}
+
+// manifestData returns the frames manifest of file, frames are extracted
+// if it is not cached
+func (fs *ImageFs) manifestData(file *fileNode) (FileData, fuse.Status) {
+	key := filepath.Join(file.path+FramesDirSuffix, FramesManifestName)
+	if data, ok := fs.Contents.Get(key); ok {
+		return data, fuse.OK
+	}
+	_, code := fs.extractFrames(file, 0)
+	if !code.Ok() {
+		return nil, code
+	}
+	if data, ok := fs.Contents.Get(key); ok {
+		return data, fuse.OK
+	}
+	return nil, fuse.EIO
+}
+
+func (fs *ImageFs) framesManifest(file *fileNode) (*FramesManifest, fuse.Status) {
+	data, code := fs.manifestData(file)
+	if !code.Ok() {
+		return nil, code
+	}
+	manifest := &FramesManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fuse.EIO
+	}
+	return manifest, fuse.OK
+}
+
+// frameData returns the png of frame name of file, frames are extracted
+// again from it if it is evicted from cache
+func (fs *ImageFs) frameData(file *fileNode, name string) (FileData, fuse.Status) {
+	if data, ok := fs.Contents.Get(filepath.Join(file.path+FramesDirSuffix, name)); ok {
+		return data, fuse.OK
+	}
+	manifest, code := fs.framesManifest(file)
+	if !code.Ok() {
+		return nil, code
+	}
+	for _, frame := range manifest.Frames {
+		if frame.Name != name {
+			continue
+		}
+		frames, code := fs.extractFrames(file, frame.Index-1)
+		if !code.Ok() {
+			return nil, code
+		}
+		if data, ok := frames[name]; ok {
+			return data, fuse.OK
+		}
+		return nil, fuse.EIO
+	}
+	return nil, fuse.ENOENT
+}
+
+func frameName(index int, delay time.Duration) string {
+	return fmt.Sprintf("frame_%04d_%dms.png", index+1, int64(delay/time.Millisecond))
+}
+
+// extractFrames decodes the animated image file frame by frame and puts
+// pngs of frames from index from into content cache, until they take a
+// quarter of the cache budget, so sequential reads of frames do not evict
+// each other. Later frames are extracted again when they are read. The
+// manifest of frames is also cached, frames are decoded to the end if it
+// is not cached. It returns the frames encoded.
+func (fs *ImageFs) extractFrames(file *fileNode, from int) (map[string]FileData, fuse.Status) {
+	data, code := fs.fileData(file)
+	if !code.Ok() {
+		return nil, code
+	}
+	dir := file.path + FramesDirSuffix
+	manifestKey := filepath.Join(dir, FramesManifestName)
+	_, hasManifest := fs.Contents.Get(manifestKey)
+	limit := fs.Contents.Stats().Budget / 4
+
+	frames := make(map[string]FileData)
+	var encoded int64
+	anim, err := decodeAnimation(data, func(i int, canvas *image.RGBA, delay time.Duration) error {
+		if i < from {
+			return nil
+		}
+		if limit > 0 && encoded >= limit {
+			if hasManifest {
+				return errStopFrames
+			}
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, canvas); err != nil {
+			return fmt.Errorf("encode frame %d with error: %s", i+1, err)
+		}
+		name := frameName(i, delay)
+		frames[name] = buf.Bytes()
+		encoded += int64(buf.Len())
+		fs.Contents.Put(filepath.Join(dir, name), buf.Bytes())
+		return nil
+	})
+	if err != nil {
+		log.Printf("decode frames of %s with error: %s", file.path, err)
+		return nil, fuse.EIO
+	}
+	log.Printf("extract %d frames of %s from frame %d", len(frames), file.path, from+1)
+	if hasManifest {
+		return frames, fuse.OK
+	}
+
+	manifest := &FramesManifest{
+		Source:    filepath.Base(file.path),
+		Width:     anim.width,
+		Height:    anim.height,
+		LoopCount: anim.loopCount,
+		Frames:    make([]FrameInfo, 0, len(anim.delays)),
+	}
+	for i, delay := range anim.delays {
+		manifest.Frames = append(manifest.Frames, FrameInfo{
+			Name:    frameName(i, delay),
+			Index:   i + 1,
+			DelayMs: int64(delay / time.Millisecond),
+		})
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	fs.Contents.Put(manifestKey, append(content, '\n'))
+	return frames, fuse.OK
+}
+
+// dropFrames removes cached frames of file from content cache and drops
+// their nodes, caller must hold fs.mu
+func (fs *ImageFs) dropFrames(file *fileNode) {
+	file.framesDir.frames = nil
+	dir := file.path + FramesDirSuffix
+	key := filepath.Join(dir, FramesManifestName)
+	data, ok := fs.Contents.Get(key)
+	if !ok {
+		return
+	}
+	manifest := &FramesManifest{}
+	if err := json.Unmarshal(data, manifest); err == nil {
+		for _, frame := range manifest.Frames {
+			fs.Contents.Remove(filepath.Join(dir, frame.Name))
+		}
+	}
+	fs.Contents.Remove(key)
+}
@@ -0,0 +1,333 @@
+package viewer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// testGifData returns an animated gif of n frames, frame i is drawn in a
+// rect shrinking with i and kept, cleared or restored after it
+func testGifData(n, w, h int) []byte {
+	palette := color.Palette{color.Transparent, color.White, color.Black, color.RGBA{255, 0, 0, 255}}
+	disposals := []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious}
+	anim := &gif.GIF{Config: image.Config{Width: w, Height: h, ColorModel: palette}}
+	for i := 0; i < n; i++ {
+		rect := image.Rect(i%w, i%h, w, h)
+		img := image.NewPaletted(rect, palette)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				img.SetColorIndex(x, y, uint8((x+y+i)%len(palette)))
+			}
+		}
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, i+1)
+		anim.Disposal = append(anim.Disposal, disposals[i%len(disposals)])
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFrameLookup(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><img src="a.gif"></html>`)
+		case "/a.gif":
+			w.Write(testGifData(5, 8, 6))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	fs := newTestImageFs(srv.URL + "/")
+	defer fs.cancel()
+	if _, err := fs.root.loadForeground(srv.URL + "/"); err != nil {
+		t.Fatalf("crawl %s: %s", srv.URL, err)
+	}
+	var attr fuse.Attr
+	dir, code := fs.root.Lookup(&attr, "a.gif"+FramesDirSuffix, nil)
+	if !code.Ok() {
+		t.Fatalf("lookup frames of a.gif: %s", code)
+	}
+	frames := dir.Node().(*framesNode)
+	manifest, code := fs.framesManifest(frames.file)
+	if !code.Ok() {
+		t.Fatalf("frames manifest of a.gif: %s", code)
+	}
+	if len(manifest.Frames) != 5 {
+		t.Fatalf("a.gif has %d frames in manifest, want 5", len(manifest.Frames))
+	}
+
+	for _, name := range []string{FramesManifestName, manifest.Frames[2].Name} {
+		first, code := frames.Lookup(&attr, name, nil)
+		if !code.Ok() {
+			t.Fatalf("lookup %s: %s", name, code)
+		}
+		second, code := frames.Lookup(&attr, name, nil)
+		if !code.Ok() {
+			t.Fatalf("lookup %s again: %s", name, code)
+		}
+		if first != second {
+			t.Errorf("lookups of %s return different inodes", name)
+		}
+	}
+
+	// stat of an evicted frame must not extract it again
+	path := filepath.Join(frames.path, manifest.Frames[2].Name)
+	fs.Contents.Remove(path)
+	if code := frames.frameNode(manifest.Frames[2].Name).GetAttr(&attr, nil, nil); !code.Ok() {
+		t.Fatalf("stat %s: %s", path, code)
+	}
+	if attr.Size != 0 {
+		t.Errorf("size of evicted frame is %d, want 0", attr.Size)
+	}
+	if _, ok := fs.Contents.Get(path); ok {
+		t.Errorf("stat of evicted frame extracts it again")
+	}
+}
+
+func TestSplitGif(t *testing.T) {
+	for _, n := range []int{1, 2, 7} {
+		data := testGifData(n, 8, 6)
+		header, blocks := splitGif(data)
+		if len(header) != 13+3*4 {
+			t.Errorf("gif of %d frames: header of %d bytes, want %d", n, len(header), 13+3*4)
+		}
+		if len(blocks) != n || countFrames(data) != n {
+			t.Errorf("gif of %d frames: split into %d blocks, counted %d", n, len(blocks), countFrames(data))
+		}
+		// frames counted on the head of a gif never exceed the real count
+		// and grow with the head
+		last := 0
+		for cut := 0; cut <= len(data); cut++ {
+			count := countFrames(data[:cut])
+			if count < last || count > n {
+				t.Fatalf("gif of %d frames: counted %d frames in %d bytes after %d", n, count, cut, last)
+			}
+			last = count
+		}
+	}
+	for _, data := range [][]byte{nil, []byte("GIF89a"), testPngData(2, 2), []byte("not an image at all")} {
+		if count := countFrames(data); count != 0 {
+			t.Errorf("counted %d frames in %q", count, data)
+		}
+	}
+}
+
+// composeGif composes frames of data on the full canvas with gif.DecodeAll
+func composeGif(t *testing.T, data []byte) []*image.RGBA {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode gif: %s", err)
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]*image.RGBA, 0, len(g.Image))
+	for i, img := range g.Image {
+		previous := image.NewRGBA(canvas.Rect)
+		copy(previous.Pix, canvas.Pix)
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Over)
+		frame := image.NewRGBA(canvas.Rect)
+		copy(frame.Pix, canvas.Pix)
+		frames = append(frames, frame)
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+func TestDecodeGif(t *testing.T) {
+	data := testGifData(7, 8, 6)
+	want := composeGif(t, data)
+	count := 0
+	anim, err := decodeAnimation(data, func(i int, canvas *image.RGBA, delay time.Duration) error {
+		if !bytes.Equal(canvas.Pix, want[i].Pix) {
+			t.Errorf("frame %d differs from gif.DecodeAll", i)
+		}
+		if delay != time.Duration(i+1)*10*time.Millisecond {
+			t.Errorf("frame %d: delay %s, want %s", i, delay, time.Duration(i+1)*10*time.Millisecond)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if count != 7 || len(anim.delays) != 7 || anim.width != 8 || anim.height != 6 {
+		t.Errorf("decoded %d frames, %d delays of %dx%d, want 7 of 8x6", count, len(anim.delays), anim.width, anim.height)
+	}
+
+	// decoding stops on errStopFrames
+	count = 0
+	anim, err = decodeAnimation(data, func(i int, canvas *image.RGBA, delay time.Duration) error {
+		count++
+		if i == 2 {
+			return errStopFrames
+		}
+		return nil
+	})
+	if err != nil || count != 3 || len(anim.delays) != 3 {
+		t.Errorf("stop after frame 2: decoded %d frames, error %v", count, err)
+	}
+
+	// sizes in the header are checked before decoding
+	huge := append([]byte{}, data...)
+	binary.LittleEndian.PutUint16(huge[6:], 0xffff)
+	binary.LittleEndian.PutUint16(huge[8:], 0xffff)
+	if _, err := decodeAnimation(huge, func(int, *image.RGBA, time.Duration) error { return nil }); err == nil {
+		t.Errorf("gif of 65535x65535 is decoded")
+	}
+}
+
+type testApngFrame struct {
+	rect    image.Rectangle
+	color   color.RGBA
+	dispose byte
+	blend   byte
+}
+
+// testApngData returns an apng on a canvas of w x h, every frame is filled
+// with its opaque color and delayed by index+1 hundredths of a second
+func testApngData(w, h int, frames []testApngFrame) []byte {
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr, uint32(w))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(h))
+	// frames are opaque, image/png encodes them as 8 bit rgb
+	ihdr[8], ihdr[9] = 8, 2
+	writePngChunk(&buf, "IHDR", ihdr)
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl, uint32(len(frames)))
+	binary.BigEndian.PutUint32(actl[4:], 3)
+	writePngChunk(&buf, "acTL", actl)
+	seq := uint32(0)
+	for i, frame := range frames {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl, seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(frame.rect.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(frame.rect.Dy()))
+		binary.BigEndian.PutUint32(fctl[12:], uint32(frame.rect.Min.X))
+		binary.BigEndian.PutUint32(fctl[16:], uint32(frame.rect.Min.Y))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(i+1))
+		binary.BigEndian.PutUint16(fctl[22:], 100)
+		fctl[24], fctl[25] = frame.dispose, frame.blend
+		writePngChunk(&buf, "fcTL", fctl)
+		seq++
+
+		img := image.NewNRGBA(image.Rect(0, 0, frame.rect.Dx(), frame.rect.Dy()))
+		draw.Draw(img, img.Bounds(), image.NewUniform(frame.color), image.Point{}, draw.Src)
+		var encoded bytes.Buffer
+		if err := png.Encode(&encoded, img); err != nil {
+			panic(err)
+		}
+		chunks, _ := readPngChunks(encoded.Bytes())
+		for _, chunk := range chunks {
+			if chunk.typ != "IDAT" {
+				continue
+			}
+			if i == 0 {
+				writePngChunk(&buf, "IDAT", chunk.data)
+				continue
+			}
+			fdat := make([]byte, 4, 4+len(chunk.data))
+			binary.BigEndian.PutUint32(fdat, seq)
+			writePngChunk(&buf, "fdAT", append(fdat, chunk.data...))
+			seq++
+		}
+	}
+	writePngChunk(&buf, "IEND", nil)
+	return buf.Bytes()
+}
+
+func TestDecodeApng(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	white := color.RGBA{255, 255, 255, 255}
+	clear := color.RGBA{}
+	data := testApngData(4, 4, []testApngFrame{
+		{rect: image.Rect(0, 0, 4, 4), color: red},
+		{rect: image.Rect(1, 1, 3, 3), color: blue, dispose: 1},
+		{rect: image.Rect(0, 0, 1, 1), color: green, dispose: 2, blend: 1},
+		{rect: image.Rect(3, 3, 4, 4), color: white},
+	})
+	if count := countFrames(data); count != 4 {
+		t.Errorf("counted %d frames, want 4", count)
+	}
+	// expected colors of pixels on the canvas after every frame
+	want := []map[image.Point]color.RGBA{
+		{{0, 0}: red, {1, 1}: red, {3, 3}: red},
+		{{0, 0}: red, {1, 1}: blue, {2, 2}: blue, {3, 3}: red},
+		{{0, 0}: green, {1, 1}: clear, {2, 2}: clear, {3, 3}: red},
+		{{0, 0}: red, {1, 1}: clear, {3, 3}: white},
+	}
+	count := 0
+	anim, err := decodeAnimation(data, func(i int, canvas *image.RGBA, delay time.Duration) error {
+		for p, c := range want[i] {
+			if got := canvas.RGBAAt(p.X, p.Y); got != c {
+				t.Errorf("frame %d: pixel %v is %v, want %v", i, p, got, c)
+			}
+		}
+		if delay != time.Duration(i+1)*10*time.Millisecond {
+			t.Errorf("frame %d: delay %s, want %s", i, delay, time.Duration(i+1)*10*time.Millisecond)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if count != 4 || anim.loopCount != 3 || anim.width != 4 || anim.height != 4 {
+		t.Errorf("decoded %d frames of %dx%d looping %d times, want 4 of 4x4 looping 3 times", count, anim.width, anim.height, anim.loopCount)
+	}
+
+	outside := testApngData(4, 4, []testApngFrame{{rect: image.Rect(2, 2, 6, 6), color: red}})
+	if _, err := decodeAnimation(outside, func(int, *image.RGBA, time.Duration) error { return nil }); err == nil {
+		t.Errorf("apng with a frame out of the canvas is decoded")
+	}
+}
+
+func TestCheckAnimation(t *testing.T) {
+	cases := []struct {
+		width, height uint64
+		frames        int
+		ok            bool
+	}{
+		{1, 1, 1, true},
+		{4096, 4096, maxFrames, true},
+		{0, 10, 1, false},
+		{10, 0, 1, false},
+		{4097, 4096, 1, false},
+		{1 << 32, 1, 1, false},
+		{maxCanvasPixels, 1, 1, true},
+		{maxCanvasPixels + 1, 1, 1, false},
+		{1 << 33, 1 << 33, 1, false},
+		{10, 10, maxFrames + 1, false},
+	}
+	for _, c := range cases {
+		if err := checkAnimation(c.width, c.height, c.frames); (err == nil) != c.ok {
+			t.Errorf("check %dx%d of %d frames: error %v, want ok %v", c.width, c.height, c.frames, err, c.ok)
+		}
+	}
+}
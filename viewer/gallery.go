@@ -0,0 +1,131 @@
+// Browsable html gallery of every crawled directory
+
+package viewer
+
+import (
+	"bytes"
+	"html/template"
+	"net/url"
+	"path"
+	"sort"
+)
+
+// html page in every crawled directory showing thumbnails of its images
+// and linking to galleries of sub directories
+const GalleryFileName = "index.html"
+
+type galleryItem struct {
+	Name    string
+	Link    string
+	Thumb   string
+	Caption string
+}
+
+type galleryPage struct {
+	Title  string
+	Url    string
+	Parent bool
+	Dirs   []galleryItem
+	Images []galleryItem
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { margin: 0; padding: 16px; font-family: sans-serif; background: #f0f0f0; color: #202020; }
+h1 { font-size: 1.2em; margin: 0 0 4px; word-break: break-all; }
+.source { font-size: 0.8em; margin-bottom: 16px; word-break: break-all; }
+.dirs { list-style: none; padding: 0; margin: 0 0 16px; }
+.dirs li { display: inline-block; margin: 0 8px 8px 0; }
+.dirs a { display: block; padding: 4px 8px; background: #fff; border-radius: 4px; text-decoration: none; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(180px, 1fr)); gap: 12px; }
+figure { margin: 0; background: #fff; border-radius: 4px; overflow: hidden; }
+figure a { display: flex; align-items: center; justify-content: center; height: 180px; background: #e0e0e0; }
+figure img { max-width: 100%; max-height: 100%; }
+figcaption { padding: 4px 8px; font-size: 0.8em; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Url}}<div class="source"><a href="{{.Url}}">{{.Url}}</a></div>{{end}}
+{{if or .Parent .Dirs}}<ul class="dirs">
+{{if .Parent}}<li><a href="../index.html">..</a></li>{{end}}
+{{range .Dirs}}<li><a href="{{.Link}}">{{.Name}}/</a></li>
+{{end}}</ul>{{end}}
+<div class="grid">
+{{range .Images}}<figure><a href="{{.Link}}"><img src="{{.Thumb}}" alt="{{.Caption}}" loading="lazy"></a><figcaption title="{{.Caption}}">{{.Caption}}</figcaption></figure>
+{{end}}</div>
+</body>
+</html>
+`))
+
+// relativeLink returns a relative url of the file at p, p is relative to
+// the directory of the page
+func relativeLink(p string) string {
+	return (&url.URL{Path: p}).String()
+}
+
+// galleryPage collects the gallery of the directory, caller must hold fs.mu
+func (d *dirNode) galleryPage() *galleryPage {
+	page := &galleryPage{Title: "/" + d.path, Parent: d.path != ""}
+	if d.page != nil {
+		page.Url = d.page.Url
+	}
+	if d.path == "" {
+		names := make([]string, 0, len(d.fs.sites))
+		for name := range d.fs.sites {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			page.Dirs = append(page.Dirs, galleryItem{
+				Name: name,
+				Link: relativeLink(path.Join(name, GalleryFileName)),
+			})
+		}
+	}
+	if d.entries == nil {
+		return page
+	}
+	thumbs := findView(ThumbsDirName)
+	for _, entry := range d.entries.ToDirEntries() {
+		switch child := d.children[entry.Name].(type) {
+		case *dirNode:
+			page.Dirs = append(page.Dirs, galleryItem{
+				Name: entry.Name,
+				Link: relativeLink(path.Join(entry.Name, GalleryFileName)),
+			})
+		case *fileNode:
+			item := galleryItem{
+				Name:    entry.Name,
+				Link:    relativeLink(entry.Name),
+				Thumb:   relativeLink(entry.Name),
+				Caption: child.meta.Alt,
+			}
+			if canConvert(child.meta.ContentType) {
+				item.Thumb = relativeLink(path.Join(thumbs.name, thumbs.fileName(entry.Name)))
+			}
+			if item.Caption == "" {
+				item.Caption = entry.Name
+			}
+			page.Images = append(page.Images, item)
+		}
+	}
+	return page
+}
+
+// galleryContent renders the gallery of the directory
+func (d *dirNode) galleryContent() (FileData, error) {
+	d.fs.mu.RLock()
+	page := d.galleryPage()
+	d.fs.mu.RUnlock()
+	var buf bytes.Buffer
+	if err := galleryTemplate.Execute(&buf, page); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,60 @@
+package viewer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestRootGalleryWithoutBaseUrl(t *testing.T) {
+	fs := newTestImageFs("", NewSite("cats", "http://example.com/cats/", NewOptions()))
+	defer fs.cancel()
+
+	entries, code := fs.root.OpenDir(nil)
+	if !code.Ok() {
+		t.Fatalf("open mount root: %s", code)
+	}
+	listed := false
+	for _, entry := range entries {
+		if entry.Name == GalleryFileName {
+			listed = true
+		}
+	}
+	if !listed {
+		t.Errorf("%s is not listed in mount root: %v", GalleryFileName, entries)
+	}
+
+	node, ok := fs.root.child(GalleryFileName).(*specialNode)
+	if !ok {
+		t.Fatalf("%s is not found in mount root", GalleryFileName)
+	}
+	var attr fuse.Attr
+	if code := node.GetAttr(&attr, nil, nil); !code.Ok() {
+		t.Fatalf("stat %s: %s", GalleryFileName, code)
+	}
+
+	data, _, code := fs.root.virtualContent(GalleryFileName)
+	if !code.Ok() {
+		t.Fatalf("read %s: %s", GalleryFileName, code)
+	}
+	if !strings.Contains(string(data), `href="cats/index.html"`) {
+		t.Errorf("gallery of mount root does not link to site cats:\n%s", data)
+	}
+	if attr.Size != uint64(len(data)) {
+		t.Errorf("size of %s is %d, want %d", GalleryFileName, attr.Size, len(data))
+	}
+}
+
+func TestGalleryOnlyInMountRootWithoutPage(t *testing.T) {
+	fs := newTestImageFs("", NewSite("cats", "", NewOptions()))
+	defer fs.cancel()
+
+	site := fs.sites["cats"]
+	if child := site.child(GalleryFileName); child != nil {
+		t.Errorf("%s is found in site not crawled yet", GalleryFileName)
+	}
+	if _, _, code := site.virtualContent(GalleryFileName); code != fuse.ENOENT {
+		t.Errorf("read %s of site not crawled yet: %s, want %s", GalleryFileName, code, fuse.ENOENT)
+	}
+}
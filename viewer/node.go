@@ -0,0 +1,505 @@
+// Inode based nodes of the file system, every directory node owns its url,
+// children and crawl state
+
+package viewer
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// indexKey returns the key of path in persistent index and content cache,
+// mount root is keyed by "/"
+func indexKey(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// baseNode implements operations shared by all nodes of ImageFs
+type baseNode struct {
+	nodefs.Node
+
+	fs *ImageFs
+
+	// full path from mount root, "" for mount root
+	path string
+}
+
+func newBaseNode(fs *ImageFs, path string) baseNode {
+	return baseNode{Node: nodefs.NewDefaultNode(), fs: fs, path: path}
+}
+
+func (n *baseNode) StatFs() *fuse.StatfsOut {
+	return n.fs.statFs()
+}
+
+func (n *baseNode) ListXAttr(context *fuse.Context) ([]string, fuse.Status) {
+	return []string{}, fuse.OK
+}
+
+func (n *baseNode) Truncate(file nodefs.File, size uint64, context *fuse.Context) fuse.Status {
+	if n.fs.readOnly() {
+		return erofs
+	}
+	return fuse.EPERM
+}
+
+// dirNode is a directory crawled from a page
+type dirNode struct {
+	baseNode
+
+	// crawl root the directory belongs to, mount root or a site, and the
+	// depth of the directory under it
+	top   *dirNode
+	depth int
+
+	// crawling options, only set on crawl roots
+	site *Site
+
+	// url the directory is crawled from, empty for mount root without
+	// base url or a site waiting for its url
+	url  string
+	attr fuse.Attr
+
+	// entries in the order they appear in the page, nil until crawled
+	entries *DirEntryList
+
+	// child nodes by name, either *dirNode or *fileNode
+	children map[string]nodefs.Node
+
+	// the page the directory is crawled from and the last time it is crawled
+	page    *PageInfo
+	crawled time.Time
+
+	// whether the directory is being refreshed in background
+	refreshing bool
+
+	// closed when the running crawl of an uncrawled directory finishes
+	loading chan struct{}
+
+	// virtual directories of views by name
+	viewDirs map[string]*viewNode
+
+	// control, virtual and archive files by name, created with the
+	// directory so their inodes are kept across lookups
+	specials map[string]nodefs.Node
+}
+
+// newDirNode creates a directory named name under parent, parent is nil for
+// crawl roots
+func (fs *ImageFs) newDirNode(parent *dirNode, name string, link string, mtime time.Time) *dirNode {
+	path := name
+	if parent != nil {
+		path = filepath.Join(parent.path, name)
+	}
+	d := &dirNode{
+		baseNode: newBaseNode(fs, path),
+		url:      link,
+		attr:     fs.newAttr(path, fuse.S_IFDIR|0755, 0, mtime),
+		children: make(map[string]nodefs.Node),
+		viewDirs: make(map[string]*viewNode, len(views)),
+	}
+	for _, v := range views {
+		d.viewDirs[v.name] = fs.newViewNode(d, v)
+	}
+	d.specials = map[string]nodefs.Node{
+		RefreshFileName: fs.newControlNode(d, RefreshFileName),
+	}
+	for _, name := range virtualFileNames {
+		d.specials[name] = fs.newVirtualNode(d, name)
+	}
+	for _, name := range archiveFileNames {
+		d.specials[name] = fs.newArchiveNode(d, name)
+	}
+	if path == "" {
+		d.specials[ControlFileName] = fs.newControlNode(d, ControlFileName)
+	} else if parent == nil {
+		// .url of a site is writable to set its url
+		d.specials[UrlFileName] = fs.newSiteUrlNode(d)
+	}
+	if parent == nil {
+		d.top = d
+	} else {
+		d.top = parent.top
+		d.depth = parent.depth + 1
+	}
+	return d
+}
+
+// isSite returns whether the directory is a site in mount root
+func (d *dirNode) isSite() bool {
+	return d.site != nil && d.path != ""
+}
+
+func (d *dirNode) OnMount(conn *nodefs.FileSystemConnector) {
+	d.fs.conn = conn
+}
+
+func (d *dirNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+	*out = d.attr
+	return fuse.OK
+}
+
+// child returns the node of name in the directory, special files shadow
+// crawled entries with the same name
+func (d *dirNode) child(name string) nodefs.Node {
+	fs := d.fs
+	special, isSpecial := d.specials[name]
+	if isSpecial && (name == RefreshFileName || name == ControlFileName) {
+		return special
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	if d.path == "" {
+		if site, ok := fs.sites[name]; ok {
+			return site
+		}
+	}
+	if isSpecial && name == UrlFileName && d.isSite() {
+		return special
+	}
+	if isSpecial && d.page != nil && (isVirtualFileName(name) || isArchiveFileName(name)) {
+		return special
+	}
+	if isSpecial && d.path == "" && name == GalleryFileName {
+		// mount root links to sites even without base url
+		return special
+	}
+	if view, ok := d.viewDirs[name]; ok && d.page != nil {
+		return view
+	}
+	if frames := d.framesChild(name); frames != nil {
+		return frames
+	}
+	if child, ok := d.children[name]; ok {
+		return child
+	}
+	return nil
+}
+
+// Lookup resolves name in the directory, a directory not listed yet is
+// crawled first, so deep paths can be addressed directly
+func (d *dirNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	child := d.child(name)
+	if child == nil && d.resolve(name) {
+		child = d.child(name)
+	}
+	if child == nil {
+		return nil, fuse.ENOENT
+	}
+	if code := child.GetAttr(out, nil, context); !code.Ok() {
+		return nil, code
+	}
+	return d.attach(name, child), fuse.OK
+}
+
+// resolve crawls the directory for looking up name if it is not crawled
+// yet, it returns whether the directory is crawled now
+func (d *dirNode) resolve(name string) bool {
+	// crawled entries never start with a dot, do not crawl for hidden
+	// files probed by shells and file managers
+	if strings.HasPrefix(name, ".") && !isGeneratedName(name) {
+		return false
+	}
+	d.fs.mu.RLock()
+	link, crawled := d.url, d.entries != nil
+	d.fs.mu.RUnlock()
+	if crawled || link == "" {
+		return false
+	}
+	log.Printf("lookup %s in dir %s not crawled yet", name, d.path)
+	if _, err := d.loadForeground(link); err != nil {
+		log.Printf("get data from src with error: %s", err)
+		return false
+	}
+	return true
+}
+
+// loadForeground loads the directory for a request waited by the user,
+// prefetch pauses until it is done, the page it is crawling is canceled
+func (d *dirNode) loadForeground(link string) (DirContents, error) {
+	atomic.AddInt32(&d.fs.foreground, 1)
+	defer atomic.AddInt32(&d.fs.foreground, -1)
+	if d.fs.prefetch != nil {
+		d.fs.prefetch.preempt()
+	}
+	return d.load(d.fs.ctx, link)
+}
+
+// attach returns the inode of child, a new inode is added to the tree if
+// the kernel has not looked up the child yet
+func (d *dirNode) attach(name string, child nodefs.Node) *nodefs.Inode {
+	return d.fs.attachNode(d.Inode(), name, child)
+}
+
+// attachNode returns the inode of child under parent, the inode of another
+// node with the same name is replaced
+func (fs *ImageFs) attachNode(parent *nodefs.Inode, name string, child nodefs.Node) *nodefs.Inode {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if ch := parent.GetChild(name); ch != nil {
+		if ch.Node() == child {
+			return ch
+		}
+		parent.RmChild(name)
+	}
+	isDir := false
+	switch child.(type) {
+	case *dirNode, *viewNode, *framesNode:
+		isDir = true
+	}
+	return parent.NewChild(name, isDir, child)
+}
+
+// detach removes inodes of names from the tree, so they are looked up
+// again, it must not be called with fs.mu held
+func (d *dirNode) detach(names []string) {
+	if d.Inode() == nil {
+		return
+	}
+	for _, name := range names {
+		d.Inode().RmChild(name)
+	}
+}
+
+func (d *dirNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	log.Printf("OpenDir name: %s", d.path)
+	fs := d.fs
+	fs.mu.RLock()
+	link := d.url
+	crawled := d.entries != nil
+	var entries []fuse.DirEntry
+	if crawled {
+		entries = d.entries.ToDirEntries()
+	}
+	lastCrawled := d.crawled
+	fs.mu.RUnlock()
+
+	if link == "" {
+		// mount root without base url, or a site waiting for its url
+		return d.withSpecialEntries(nil), fuse.OK
+	}
+	if crawled {
+		if ttl := fs.dirTTL(link); ttl > 0 && time.Since(lastCrawled) > ttl {
+			d.refresh(link)
+		}
+	} else {
+		var err error
+		entries, err = d.loadForeground(link)
+		if err != nil {
+			log.Printf("get data from src with error: %s", err)
+			return nil, fuse.ENOENT
+		}
+	}
+	if fs.prefetch != nil {
+		fs.prefetch.start(d)
+	}
+	return d.withSpecialEntries(entries), fuse.OK
+}
+
+// withSpecialEntries appends sites, control and virtual files to entries of
+// the directory
+func (d *dirNode) withSpecialEntries(entries []fuse.DirEntry) []fuse.DirEntry {
+	if d.path == "" {
+		entries = append(entries, d.fs.siteEntries()...)
+	}
+	entries = append(entries, d.framesEntries()...)
+	entries = append(entries, controlEntries(d.path)...)
+	virtualEntries := d.virtualEntries()
+	if virtualEntries == nil && d.isSite() {
+		virtualEntries = []fuse.DirEntry{{Name: UrlFileName, Mode: fuse.S_IFREG}}
+	}
+	if virtualEntries == nil && d.path == "" {
+		virtualEntries = []fuse.DirEntry{{Name: GalleryFileName, Mode: fuse.S_IFREG}}
+	}
+	return append(entries, virtualEntries...)
+}
+
+// fileNode is an image crawled from the page of its parent directory
+type fileNode struct {
+	baseNode
+
+	parent *dirNode
+
+	// source url of the image, used to fetch data again after it is
+	// evicted from content cache
+	src string
+
+	// hash of image data in Store, empty if it is not stored
+	blob string
+
+	meta FileMeta
+	attr fuse.Attr
+
+	// blob hashes of converted files in Store by view name
+	views map[string]string
+
+	// converted files by view name, created with the file so lookups keep
+	// their inodes
+	viewFiles map[string]*specialNode
+
+	// virtual directory of frames if the image is animated
+	framesDir *framesNode
+}
+
+func (fs *ImageFs) newFileNode(parent *dirNode, name string) *fileNode {
+	file := &fileNode{
+		baseNode: newBaseNode(fs, filepath.Join(parent.path, name)),
+		parent:   parent,
+	}
+	file.viewFiles = make(map[string]*specialNode, len(views))
+	for _, v := range views {
+		file.viewFiles[v.name] = fs.newConvertedNode(v, file)
+	}
+	file.framesDir = fs.newFramesNode(file)
+	return file
+}
+
+func (n *fileNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+	*out = n.attr
+	return fuse.OK
+}
+
+func (n *fileNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	log.Printf("Open name: %s", n.path)
+	if isWriteFlags(flags) {
+		if n.fs.readOnly() {
+			return nil, erofs
+		}
+		return nil, fuse.EPERM
+	}
+	if file := n.fs.streamFile(n); file != nil {
+		return file, fuse.OK
+	}
+	data, code := n.fs.fileData(n)
+	if !code.Ok() {
+		return nil, code
+	}
+	return nodefs.NewDataFile(data), fuse.OK
+}
+
+// fileData returns data of file n, data may be evicted from cache, then it
+// is loaded from disk store or fetched again from source
+func (fs *ImageFs) fileData(n *fileNode) (FileData, fuse.Status) {
+	if data, ok := fs.Contents.Get(n.path); ok {
+		return data, fuse.OK
+	}
+
+	fs.mu.RLock()
+	src, hash := n.src, n.blob
+	fs.mu.RUnlock()
+	if hash != "" && fs.Store != nil {
+		if data, err := fs.Store.GetBlob(hash); err == nil {
+			fs.Contents.Put(n.path, data)
+			return data, fuse.OK
+		} else {
+			log.Printf("load blob of %s with error: %s", n.path, err)
+		}
+	}
+	data, _, err := fetchImage(fs.ctx, src)
+	if err != nil {
+		log.Printf("refetch %s with error: %s", src, err)
+		return nil, fuse.EIO
+	}
+	fs.Contents.Put(n.path, data)
+	if fs.Store != nil {
+		if hash, err := fs.Store.PutBlob(data); err == nil {
+			fs.mu.Lock()
+			n.blob = hash
+			fs.mu.Unlock()
+		}
+	}
+	// a streamed image is counted on its head when crawled, it may have
+	// more frames
+	if frames := countFrames(data); frames > 1 {
+		fs.mu.Lock()
+		if n.src == src && frames > n.meta.Frames {
+			n.meta.Frames = frames
+		}
+		fs.mu.Unlock()
+	}
+	return data, fuse.OK
+}
+
+// specialNode is a file generated on the fly, it is writable if write is
+// set, data written is passed to write when the file is flushed
+type specialNode struct {
+	baseNode
+
+	mode  uint32
+	data  func() (FileData, time.Time, fuse.Status)
+	write func(data string) fuse.Status
+
+	// stat returns the size and mtime of a file expensive to generate
+	// without generating it, the size is 0 until it is generated. Such
+	// files are read with direct io, so readers do not stop at the size.
+	stat func() (uint64, time.Time, fuse.Status)
+}
+
+func (fs *ImageFs) newSpecialNode(path string, mode uint32, data func() (FileData, time.Time, fuse.Status), write func(string) fuse.Status) *specialNode {
+	return &specialNode{
+		baseNode: newBaseNode(fs, path),
+		mode:     mode,
+		data:     data,
+		write:    write,
+	}
+}
+
+func (n *specialNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	if n.stat != nil {
+		size, mtime, code := n.stat()
+		if code.Ok() {
+			*out = n.fs.newAttr(n.path, fuse.S_IFREG|n.mode, size, mtime)
+		}
+		return code
+	}
+	data, mtime, code := n.data()
+	if !code.Ok() {
+		return code
+	}
+	*out = n.fs.newAttr(n.path, fuse.S_IFREG|n.mode, uint64(len(data)), mtime)
+	return fuse.OK
+}
+
+func (n *specialNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	log.Printf("Open name: %s", n.path)
+	if isWriteFlags(flags) {
+		if n.fs.readOnly() {
+			return nil, erofs
+		}
+		if n.write == nil {
+			return nil, fuse.EPERM
+		}
+		return newControlFile(n), fuse.OK
+	}
+	data, _, code := n.data()
+	if !code.Ok() {
+		return nil, code
+	}
+	if n.stat != nil {
+		return &nodefs.WithFlags{File: nodefs.NewDataFile(data), FuseFlags: fuse.FOPEN_DIRECT_IO}, fuse.OK
+	}
+	return nodefs.NewDataFile(data), fuse.OK
+}
+
+func (n *specialNode) Truncate(file nodefs.File, size uint64, context *fuse.Context) fuse.Status {
+	if n.fs.readOnly() {
+		return erofs
+	}
+	if n.write == nil {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
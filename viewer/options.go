@@ -1,13 +1,141 @@
 package viewer
 
+import (
+	"time"
+)
+
 type Options struct {
-	Headless   bool `flag:"headless"`
-	DriverPort int  `flag:"driver-port"`
+	Headless     bool `flag:"headless"`
+	DriverPort   int  `flag:"driver-port"`
+	NumberPrefix bool `flag:"number-prefix"`
+
+	// byte budget of the in memory content cache, 0 means unlimited
+	CacheSize int64 `flag:"cache-size"`
+
+	// interval of printing cache statistics, 0 disables it
+	CacheStatsInterval time.Duration `flag:"cache-stats-interval"`
+
+	// directory of the persistent store, empty disables persistence
+	CacheDir string `flag:"cache-dir"`
+
+	// listing of a directory is refreshed in background after it is older
+	// than DirTTL, 0 means never refresh
+	DirTTL time.Duration `flag:"dir-ttl"`
+
+	// per host overrides of DirTTL
+	HostTTL map[string]time.Duration `flag:"host-ttl"`
+
+	// how long the kernel caches dentries, attributes and lookup failures
+	EntryTimeout    time.Duration `flag:"entry-timeout"`
+	AttrTimeout     time.Duration `flag:"attr-timeout"`
+	NegativeTimeout time.Duration `flag:"negative-timeout"`
+
+	// owner of all files, -1 means the mounting user
+	Uid int `flag:"uid"`
+	Gid int `flag:"gid"`
+
+	// default crawling scope and max depth of sites, see Site
+	Scope string `flag:"scope"`
+	Depth int    `flag:"depth"`
+
+	// sites presented as top-level directories
+	Sites []*Site `flag:"site"`
+
+	// how long to wait for unmounting on shutdown before a lazy unmount
+	ShutdownTimeout time.Duration `flag:"shutdown-timeout"`
+
+	// allow users other than the mounting user to access the mount, needs
+	// user_allow_other in /etc/fuse.conf
+	AllowOther bool `flag:"allow-other"`
+
+	// file system name shown in mount output
+	FsName string `flag:"fsname"`
+
+	// print every FUSE request and reply
+	Debug bool `flag:"debug"`
+
+	// every mutating operation fails with EROFS
+	ReadOnly bool `flag:"read-only"`
+
+	// how many levels of sub directories are crawled in background after a
+	// directory is listed, 0 disables prefetch
+	PrefetchDepth int `flag:"prefetch-depth"`
+
+	// max pages crawled by one prefetch
+	PrefetchPages int `flag:"prefetch-pages"`
+
+	// bandwidth cap of prefetch in bytes per second, 0 means unlimited
+	PrefetchRate int64 `flag:"prefetch-rate"`
+
+	// files larger than this are read with http range requests instead of
+	// being downloaded entirely, 0 disables streaming
+	StreamSize int64 `flag:"stream-size"`
+
+	// number of chunks fetched ahead of the read offset of a streamed file
+	StreamReadAhead int `flag:"stream-read-ahead"`
+
+	// max width and height of thumbnails in .thumbs, and their jpeg quality
+	ThumbSize    int `flag:"thumb-size"`
+	ThumbQuality int `flag:"thumb-quality"`
+
+	// jpeg quality of images transcoded in .as-jpeg
+	JpegQuality int `flag:"jpeg-quality"`
+
+	// levels of sub directories included in .archive.zip and .archive.tar,
+	// 0 means only images in the directory itself
+	ArchiveDepth int `flag:"archive-depth"`
+
+	// size of cells and number of columns of .contact-sheet.jpg, and
+	// whether file names are drawn under cells
+	ContactCellSize int  `flag:"contact-cell-size"`
+	ContactColumns  int  `flag:"contact-columns"`
+	ContactCaptions bool `flag:"contact-captions"`
+
+	// called once the file system is mounted and ready to serve
+	OnReady func()
 }
 
 func NewOptions() *Options {
 	return &Options{
-		Headless:   false,
-		DriverPort: 9515,
+		Headless:           false,
+		DriverPort:         9515,
+		NumberPrefix:       false,
+		CacheSize:          256 << 20,
+		CacheStatsInterval: 0,
+		CacheDir:           "",
+		DirTTL:             0,
+		HostTTL:            make(map[string]time.Duration),
+		EntryTimeout:       time.Second,
+		AttrTimeout:        time.Second,
+		NegativeTimeout:    0,
+		Uid:                -1,
+		Gid:                -1,
+		Scope:              ScopeAll,
+		Depth:              0,
+		Sites:              make([]*Site, 0),
+		ShutdownTimeout:    10 * time.Second,
+		FsName:             "image_viewer",
+		PrefetchPages:      10,
+		PrefetchRate:       1 << 20,
+		StreamSize:         1 << 20,
+		StreamReadAhead:    4,
+		ThumbSize:          256,
+		ThumbQuality:       80,
+		JpegQuality:        90,
+		ContactCellSize:    160,
+		ContactColumns:     6,
+	}
+}
+
+// NeedHeadless returns whether headless browser should be started
+func (opts *Options) NeedHeadless() bool {
+	if opts.Headless {
+		return true
+	}
+	for _, site := range opts.Sites {
+		if site.Headless {
+			return true
+		}
 	}
+	return false
 }
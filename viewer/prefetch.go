@@ -0,0 +1,240 @@
+// Background prefetch of sub directories ahead of navigation
+
+package viewer
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type limiterKey struct{}
+
+// rateLimiter caps the bandwidth shared by all readers using it
+type rateLimiter struct {
+	// bytes per second
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes are allowed to be read
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withLimiter returns a context whose http responses are read no faster
+// than limiter allows
+func withLimiter(ctx context.Context, limiter *rateLimiter) context.Context {
+	return context.WithValue(ctx, limiterKey{}, limiter)
+}
+
+func limiterFrom(ctx context.Context) *rateLimiter {
+	limiter, _ := ctx.Value(limiterKey{}).(*rateLimiter)
+	return limiter
+}
+
+type limitedReader struct {
+	io.ReadCloser
+
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// read in small chunks so the limiter stays smooth
+	if len(p) > 32<<10 {
+		p = p[:32<<10]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// prefetcher crawls sub directories of the last listed directory in
+// background, one page at a time and only while no foreground crawl runs.
+// A page being crawled is canceled when a foreground crawl starts, and it
+// is crawled again after foreground crawls finish.
+type prefetcher struct {
+	fs *ImageFs
+
+	// nil means unlimited bandwidth
+	limiter *rateLimiter
+
+	mu      sync.Mutex
+	current *dirNode
+	cancel  context.CancelFunc
+
+	// cancels the page being crawled, nil if none
+	cancelPage context.CancelFunc
+
+	// only one prefetch crawl runs at the same time
+	running sync.Mutex
+}
+
+func newPrefetcher(fs *ImageFs) *prefetcher {
+	p := &prefetcher{fs: fs}
+	if fs.Options.PrefetchRate > 0 {
+		p.limiter = newRateLimiter(fs.Options.PrefetchRate)
+	}
+	return p
+}
+
+// start prefetches sub directories of d, a running prefetch started from
+// another directory is canceled
+func (p *prefetcher) start(d *dirNode) {
+	p.mu.Lock()
+	if p.current == d {
+		p.mu.Unlock()
+		return
+	}
+	if p.cancel != nil {
+		p.cancel()
+	}
+	ctx, cancel := context.WithCancel(p.fs.ctx)
+	if p.limiter != nil {
+		ctx = withLimiter(ctx, p.limiter)
+	}
+	p.current, p.cancel = d, cancel
+	p.mu.Unlock()
+
+	go p.run(ctx, d)
+}
+
+// waitIdle blocks until no foreground crawl runs, it returns false if ctx
+// is canceled
+func (p *prefetcher) waitIdle(ctx context.Context) bool {
+	for atomic.LoadInt32(&p.fs.foreground) > 0 {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// run crawls directories under d breadth first, up to PrefetchDepth levels
+// and PrefetchPages pages
+func (p *prefetcher) run(ctx context.Context, d *dirNode) {
+	type job struct {
+		dir   *dirNode
+		level int
+	}
+	opts := p.fs.Options
+	queue := []job{{d, 0}}
+	pages := 0
+	for len(queue) > 0 && pages < opts.PrefetchPages {
+		j := queue[0]
+		queue = queue[1:]
+		if j.level > 0 {
+			if !p.waitIdle(ctx) {
+				return
+			}
+			p.fs.mu.RLock()
+			link, crawled := j.dir.url, j.dir.entries != nil
+			p.fs.mu.RUnlock()
+			if !crawled && link != "" {
+				preempted, err := p.load(ctx, j.dir, link)
+				if preempted {
+					queue = append([]job{j}, queue...)
+					continue
+				}
+				pages++
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Printf("prefetch %s with error: %s", j.dir.path, err)
+					continue
+				}
+				log.Printf("prefetch dir %s done", j.dir.path)
+			}
+		}
+		if j.level >= opts.PrefetchDepth {
+			continue
+		}
+		for _, child := range j.dir.subDirs() {
+			queue = append(queue, job{child, j.level + 1})
+		}
+	}
+}
+
+// load crawls directory d unless a foreground crawl runs, it returns true
+// if the crawl is not started or canceled by a foreground crawl
+func (p *prefetcher) load(ctx context.Context, d *dirNode, link string) (bool, error) {
+	p.running.Lock()
+	defer p.running.Unlock()
+	pageCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p.mu.Lock()
+	if atomic.LoadInt32(&p.fs.foreground) > 0 {
+		p.mu.Unlock()
+		return true, nil
+	}
+	p.cancelPage = cancel
+	p.mu.Unlock()
+
+	_, err := d.load(pageCtx, link)
+	p.mu.Lock()
+	p.cancelPage = nil
+	p.mu.Unlock()
+	if err != nil && ctx.Err() == nil && pageCtx.Err() != nil {
+		return true, nil
+	}
+	return false, err
+}
+
+// preempt cancels the page being crawled, it must be called after the
+// foreground crawl is counted in fs.foreground
+func (p *prefetcher) preempt() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancelPage != nil {
+		p.cancelPage()
+	}
+}
+
+// subDirs returns sub directories in the order they appear in the page
+func (d *dirNode) subDirs() []*dirNode {
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+	dirs := make([]*dirNode, 0)
+	if d.entries == nil {
+		return dirs
+	}
+	for _, entry := range d.entries.ToDirEntries() {
+		if child, ok := d.children[entry.Name].(*dirNode); ok {
+			dirs = append(dirs, child)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,101 @@
+// Read-only mount, every mutating operation fails with EROFS
+
+package viewer
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+var erofs = fuse.Status(syscall.EROFS)
+
+func (fs *ImageFs) readOnly() bool {
+	return fs.Options.ReadOnly
+}
+
+func (n *baseNode) Chmod(file nodefs.File, perms uint32, context *fuse.Context) fuse.Status {
+	if n.fs.readOnly() {
+		return erofs
+	}
+	return n.Node.Chmod(file, perms, context)
+}
+
+func (n *baseNode) Chown(file nodefs.File, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if n.fs.readOnly() {
+		return erofs
+	}
+	return n.Node.Chown(file, uid, gid, context)
+}
+
+func (n *baseNode) Utimens(file nodefs.File, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if n.fs.readOnly() {
+		return erofs
+	}
+	return n.Node.Utimens(file, atime, mtime, context)
+}
+
+func (n *baseNode) Fallocate(file nodefs.File, off uint64, size uint64, mode uint32, context *fuse.Context) fuse.Status {
+	if n.fs.readOnly() {
+		return erofs
+	}
+	return n.Node.Fallocate(file, off, size, mode, context)
+}
+
+func (n *baseNode) Link(name string, existing nodefs.Node, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	if n.fs.readOnly() {
+		return nil, erofs
+	}
+	return n.Node.Link(name, existing, context)
+}
+
+func (n *baseNode) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	if n.fs.readOnly() {
+		return nil, erofs
+	}
+	return n.Node.Mknod(name, mode, dev, context)
+}
+
+func (n *baseNode) Rename(oldName string, newParent nodefs.Node, newName string, context *fuse.Context) fuse.Status {
+	if n.fs.readOnly() {
+		return erofs
+	}
+	return n.Node.Rename(oldName, newParent, newName, context)
+}
+
+func (n *baseNode) Unlink(name string, context *fuse.Context) fuse.Status {
+	if n.fs.readOnly() {
+		return erofs
+	}
+	return n.Node.Unlink(name, context)
+}
+
+func (n *baseNode) RemoveXAttr(attr string, context *fuse.Context) fuse.Status {
+	if n.fs.readOnly() {
+		return erofs
+	}
+	return n.Node.RemoveXAttr(attr, context)
+}
+
+func (n *baseNode) SetXAttr(attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if n.fs.readOnly() {
+		return erofs
+	}
+	return n.Node.SetXAttr(attr, data, flags, context)
+}
+
+func (n *baseNode) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, *nodefs.Inode, fuse.Status) {
+	if n.fs.readOnly() {
+		return nil, nil, erofs
+	}
+	return n.Node.Create(name, flags, mode, context)
+}
+
+func (n *baseNode) Symlink(name string, content string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	if n.fs.readOnly() {
+		return nil, erofs
+	}
+	return n.Node.Symlink(name, content, context)
+}
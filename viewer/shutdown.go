@@ -0,0 +1,64 @@
+// Graceful shutdown on SIGINT and SIGTERM
+
+package viewer
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// notifyShutdown returns a channel receiving SIGINT and SIGTERM, it is
+// registered before mounting, so a signal during startup does not kill the
+// process with the mount point left behind
+func notifyShutdown() chan os.Signal {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	return sigCh
+}
+
+// serveUntilSignal waits until the serve loop of server stops, which closes
+// serveDone, after the file system is unmounted, or a signal is received
+// from sigCh. On signal in-flight crawls are canceled and the mount point
+// is unmounted.
+func (fs *ImageFs) serveUntilSignal(server *fuse.Server, serveDone <-chan struct{}, sigCh <-chan os.Signal) {
+	select {
+	case <-serveDone:
+		log.Printf("file system is unmounted")
+		fs.cancel()
+	case sig := <-sigCh:
+		log.Printf("received %s, shutting down", sig)
+		fs.cancel()
+		unmount(server, fs.Root, fs.Options.ShutdownTimeout)
+		select {
+		case <-serveDone:
+		case <-time.After(fs.Options.ShutdownTimeout):
+			log.Printf("serve loop does not stop in %s, give up waiting", fs.Options.ShutdownTimeout)
+		}
+	}
+}
+
+// unmount tries a normal unmount first, and falls back to a lazy unmount
+// if the mount point is busy or unmounting does not finish in timeout
+func unmount(server *fuse.Server, mountpoint string, timeout time.Duration) {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Unmount()
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			return
+		}
+		log.Printf("unmount %s with error: %s", mountpoint, err)
+	case <-time.After(timeout):
+		log.Printf("unmount %s timeout after %s", mountpoint, timeout)
+	}
+	if err := lazyUnmount(mountpoint); err != nil {
+		log.Printf("lazy unmount %s with error: %s", mountpoint, err)
+	}
+}
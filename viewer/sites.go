@@ -0,0 +1,299 @@
+// Crawl roots presented as top-level directories, configured at startup or
+// created by making directories in mount root
+
+package viewer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+const (
+	// every sub link is listed as a directory
+	ScopeAll = "all"
+
+	// only sub links on the same host as the site url
+	ScopeHost = "host"
+
+	// only sub links under the site url
+	ScopePrefix = "prefix"
+)
+
+// Site is a crawl root with its own crawling options
+type Site struct {
+	Name string `json:"name"`
+
+	// url is empty until it is written to .url of the site
+	Url string `json:"url"`
+
+	Headless bool   `json:"headless"`
+	Scope    string `json:"scope"`
+
+	// max directory depth under the site, 0 means unlimited
+	Depth int `json:"depth"`
+}
+
+type SitesConfig struct {
+	Sites []*Site `json:"sites"`
+}
+
+// NewSite creates a site with crawling options inherited from opts
+func NewSite(name string, link string, opts *Options) *Site {
+	return &Site{
+		Name:     name,
+		Url:      link,
+		Headless: opts.Headless,
+		Scope:    opts.Scope,
+		Depth:    opts.Depth,
+	}
+}
+
+func (site *Site) validate() error {
+	if site.Name == "" || strings.Contains(site.Name, "/") || strings.HasPrefix(site.Name, ".") || isGeneratedName(site.Name) {
+		return fmt.Errorf("invalid site name %q", site.Name)
+	}
+	if site.Url != "" && !isCrawlUrl(site.Url) {
+		return fmt.Errorf("invalid url %q of site %s", site.Url, site.Name)
+	}
+	switch site.Scope {
+	case ScopeAll, ScopeHost, ScopePrefix:
+	default:
+		return fmt.Errorf("invalid scope %q of site %s", site.Scope, site.Name)
+	}
+	if site.Depth < 0 {
+		return fmt.Errorf("invalid depth %d of site %s", site.Depth, site.Name)
+	}
+	return nil
+}
+
+// allowLink returns whether link found in a directory at depth under the
+// site should be listed as a sub directory
+func (site *Site) allowLink(link string, depth int) bool {
+	if site.Depth > 0 && depth >= site.Depth {
+		return false
+	}
+	switch site.Scope {
+	case ScopeHost:
+		base, err1 := url.Parse(site.Url)
+		u, err2 := url.Parse(link)
+		return err1 == nil && err2 == nil && base.Host == u.Host
+	case ScopePrefix:
+		return strings.HasPrefix(link, site.Url)
+	}
+	return true
+}
+
+// LoadSitesConfig reads sites from a json config file, crawling options
+// missing in the file are inherited from opts
+func LoadSitesConfig(path string, opts *Options) ([]*Site, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &SitesConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	sites := make([]*Site, 0, len(cfg.Sites))
+	for _, item := range cfg.Sites {
+		site := NewSite(item.Name, item.Url, opts)
+		// json has no way to tell a missing bool from false, so headless
+		// can only be turned on per site
+		site.Headless = site.Headless || item.Headless
+		if item.Scope != "" {
+			site.Scope = item.Scope
+		}
+		if item.Depth != 0 {
+			site.Depth = item.Depth
+		}
+		if err := site.validate(); err != nil {
+			return nil, err
+		}
+		sites = append(sites, site)
+	}
+	return sites, nil
+}
+
+// ParseSite parses a site in name=url format
+func ParseSite(value string, opts *Options) (*Site, error) {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid site %q, should be name=url", value)
+	}
+	site := NewSite(fields[0], fields[1], opts)
+	if err := site.validate(); err != nil {
+		return nil, err
+	}
+	return site, nil
+}
+
+// isCrawlUrl returns whether link can be crawled
+func isCrawlUrl(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// newSiteUrlNode creates .url of site d, the file is writable to set the
+// url of the site
+func (fs *ImageFs) newSiteUrlNode(d *dirNode) *specialNode {
+	data := func() (FileData, time.Time, fuse.Status) {
+		return d.siteUrlContent(), time.Now(), fuse.OK
+	}
+	return fs.newSpecialNode(filepath.Join(d.path, UrlFileName), 0644, data, fs.setSiteUrl(d))
+}
+
+func (d *dirNode) siteUrlContent() FileData {
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+	if d.url != "" {
+		return FileData(d.url + "\n")
+	}
+	return FileData{}
+}
+
+// siteEntries returns site directories listed in mount root
+func (fs *ImageFs) siteEntries() []fuse.DirEntry {
+	fs.mu.RLock()
+	names := make([]string, 0, len(fs.sites))
+	for name := range fs.sites {
+		names = append(names, name)
+	}
+	fs.mu.RUnlock()
+	sort.Strings(names)
+	entries := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR})
+	}
+	return entries
+}
+
+// setSiteUrl returns a function setting the url of site d to data written
+// to its .url file, the old tree of the site is dropped
+func (fs *ImageFs) setSiteUrl(d *dirNode) func(string) fuse.Status {
+	return func(data string) fuse.Status {
+		link := strings.TrimSpace(data)
+		if !isCrawlUrl(link) {
+			return fuse.EINVAL
+		}
+		fs.mu.RLock()
+		old := d.url
+		fs.mu.RUnlock()
+		if old == link {
+			return fuse.OK
+		}
+		d.drop()
+		fs.mu.Lock()
+		updated := *d.site
+		updated.Url = link
+		d.site = &updated
+		d.url = link
+		fs.mu.Unlock()
+		log.Printf("set url of site %s to %s", d.path, link)
+		fs.invalidate(d, []string{UrlFileName})
+		fs.saveIndex()
+		return fuse.OK
+	}
+}
+
+// addSite adds a configured site, an existing site with the same name is
+// replaced if its url changes. A site named like an entry of mount root is
+// refused, they would share paths.
+func (fs *ImageFs) addSite(site *Site) error {
+	fs.mu.RLock()
+	d, ok := fs.sites[site.Name]
+	var old string
+	if ok {
+		old = d.url
+	}
+	_, taken := fs.root.children[site.Name]
+	fs.mu.RUnlock()
+	if taken {
+		return fmt.Errorf("site %s has the name of an entry in mount root", site.Name)
+	}
+	if ok && old != site.Url {
+		log.Printf("url of site %s changes from %s to %s", site.Name, old, site.Url)
+		d.forget()
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !ok {
+		d = fs.newDirNode(nil, site.Name, site.Url, time.Now())
+		fs.sites[site.Name] = d
+	}
+	d.site = site
+	d.url = site.Url
+	return nil
+}
+
+// Mkdir creates a new crawl root in mount root, a directory named with an
+// url encoded link is crawled from the link, otherwise the link should be
+// written to .url in the new directory
+func (d *dirNode) Mkdir(name string, mode uint32, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	fs := d.fs
+	if fs.readOnly() {
+		return nil, erofs
+	}
+	if d.path != "" {
+		return nil, fuse.EPERM
+	}
+	if d.child(name) != nil {
+		return nil, fuse.Status(syscall.EEXIST)
+	}
+	link := ""
+	if decoded, err := url.QueryUnescape(name); err == nil && isCrawlUrl(decoded) {
+		link = decoded
+	}
+
+	site := fs.newDirNode(nil, name, link, time.Now())
+	site.site = NewSite(name, link, fs.Options)
+	fs.mu.Lock()
+	if _, ok := fs.sites[name]; ok {
+		fs.mu.Unlock()
+		return nil, fuse.Status(syscall.EEXIST)
+	}
+	fs.sites[name] = site
+	fs.mu.Unlock()
+
+	log.Printf("mkdir site %s with url %q", name, link)
+	fs.saveIndex()
+	return d.attach(name, site), fuse.OK
+}
+
+// Rmdir drops a crawl root created by Mkdir
+func (d *dirNode) Rmdir(name string, context *fuse.Context) fuse.Status {
+	fs := d.fs
+	if fs.readOnly() {
+		return erofs
+	}
+	fs.mu.RLock()
+	site, ok := fs.sites[name]
+	fs.mu.RUnlock()
+	if d.path != "" || !ok {
+		return fuse.EPERM
+	}
+	// the kernel holds the directory during rmdir, do not notify it
+	site.forget()
+	fs.mu.Lock()
+	delete(fs.sites, name)
+	fs.mu.Unlock()
+	d.detach([]string{name})
+
+	log.Printf("rmdir site %s", name)
+	fs.saveIndex()
+	return fuse.OK
+}
@@ -0,0 +1,99 @@
+package viewer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestMkdirSiteThenWriteUrl(t *testing.T) {
+	fs := newTestImageFs("")
+	defer fs.cancel()
+
+	if _, code := fs.root.Mkdir("foo", 0755, nil); !code.Ok() {
+		t.Fatalf("mkdir foo: %s", code)
+	}
+	var attr fuse.Attr
+	dir, code := fs.root.Lookup(&attr, "foo", nil)
+	if !code.Ok() {
+		t.Fatalf("lookup foo: %s", code)
+	}
+	site := dir.Node().(*dirNode)
+	inode, code := site.Lookup(&attr, UrlFileName, nil)
+	if !code.Ok() {
+		t.Fatalf("lookup foo/%s: %s", UrlFileName, code)
+	}
+	node := inode.Node().(*specialNode)
+
+	file, code := node.Open(uint32(os.O_WRONLY|os.O_TRUNC), nil)
+	if !code.Ok() {
+		t.Fatalf("open foo/%s for write: %s", UrlFileName, code)
+	}
+	link := "http://example.com/foo/"
+	if _, code := file.Write([]byte(link+"\n"), 0); !code.Ok() {
+		t.Fatalf("write foo/%s: %s", UrlFileName, code)
+	}
+	if code := file.Flush(); !code.Ok() {
+		t.Fatalf("flush foo/%s: %s", UrlFileName, code)
+	}
+	if site.url != link {
+		t.Errorf("url of site foo is %q, want %q", site.url, link)
+	}
+
+	file, code = node.Open(uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("open foo/%s: %s", UrlFileName, code)
+	}
+	buf := make([]byte, 256)
+	res, code := file.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatalf("read foo/%s: %s", UrlFileName, code)
+	}
+	data, _ := res.Bytes(buf)
+	if string(data) != link+"\n" {
+		t.Errorf("foo/%s reads %q, want %q", UrlFileName, data, link+"\n")
+	}
+}
+
+func TestSiteNamedLikeRootEntry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `<html><a href="cats">cats</a><a href="dogs">dogs</a></html>`)
+	}))
+	defer srv.Close()
+	// sub directories are named after the url of links
+	host := strings.TrimPrefix(srv.URL, "http://")
+	cats, dogs := host+"_cats", host+"_dogs"
+
+	// a site hides the entry of mount root with its name
+	fs := newTestImageFs(srv.URL+"/", NewSite(cats, "http://example.com/cats/", NewOptions()))
+	defer fs.cancel()
+	if _, err := fs.root.loadForeground(srv.URL + "/"); err != nil {
+		t.Fatalf("crawl %s: %s", srv.URL, err)
+	}
+	if _, ok := fs.root.children[cats]; ok {
+		t.Errorf("mount root has entry cats of site cats")
+	}
+	if _, ok := fs.root.children[dogs]; !ok {
+		t.Errorf("mount root has no entry dogs")
+	}
+	if fs.root.child(cats) != fs.sites[cats] {
+		t.Errorf("cats in mount root is not site cats")
+	}
+
+	// a site is refused if mount root has an entry with its name
+	if err := fs.addSite(NewSite(dogs, "http://example.com/dogs/", NewOptions())); err == nil {
+		t.Errorf("site dogs is added with entry dogs in mount root")
+	}
+	if _, ok := fs.sites[dogs]; ok {
+		t.Errorf("site dogs is added")
+	}
+}
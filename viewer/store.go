@@ -0,0 +1,150 @@
+// Disk backed content store and metadata index
+
+package viewer
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	blobDirName  = "blobs"
+	indexVersion = 3
+)
+
+// Index is the persistent metadata of a crawled tree, all maps are keyed by
+// full path in the mounted file system.
+type Index struct {
+	Version int
+	BaseUrl string
+
+	Attrs   map[string]fuse.Attr
+	Entries map[string][]fuse.DirEntry
+	Urls    map[string]string
+	Sources map[string]string
+
+	// mapping from full path of a file to its blob hash
+	Blobs map[string]string
+
+	// mapping from full path of a directory to the unix time it is crawled
+	Crawled map[string]int64
+
+	Meta  map[string]FileMeta
+	Pages map[string]*PageInfo
+	Sites map[string]*Site
+}
+
+func NewIndex(baseUrl string) *Index {
+	return &Index{
+		Version: indexVersion,
+		BaseUrl: baseUrl,
+		Attrs:   make(map[string]fuse.Attr),
+		Entries: make(map[string][]fuse.DirEntry),
+		Urls:    make(map[string]string),
+		Sources: make(map[string]string),
+		Blobs:   make(map[string]string),
+		Crawled: make(map[string]int64),
+		Meta:    make(map[string]FileMeta),
+		Pages:   make(map[string]*PageInfo),
+		Sites:   make(map[string]*Site),
+	}
+}
+
+// Store saves file data as content addressed blobs and keeps one metadata
+// index for each base url under Dir.
+type Store struct {
+	Dir string
+
+	// serializes index writing
+	mu sync.Mutex
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, blobDirName), 0755); err != nil {
+		return nil, err
+	}
+	return &Store{Dir: dir}, nil
+}
+
+func (s *Store) blobPath(hash string) string {
+	return filepath.Join(s.Dir, blobDirName, hash[:2], hash)
+}
+
+func (s *Store) indexPath(baseUrl string) string {
+	sum := sha1.Sum([]byte(baseUrl))
+	return filepath.Join(s.Dir, "index-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// writeFile writes data to a temporary file and renames it to path, so
+// readers never see a partial file.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// PutBlob stores data and returns its hash
+func (s *Store) PutBlob(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := s.blobPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	return hash, writeFile(path, data)
+}
+
+func (s *Store) GetBlob(hash string) ([]byte, error) {
+	return ioutil.ReadFile(s.blobPath(hash))
+}
+
+// LoadIndex reads the index of baseUrl, an empty index is returned if it
+// has never been saved.
+func (s *Store) LoadIndex(baseUrl string) (*Index, error) {
+	data, err := ioutil.ReadFile(s.indexPath(baseUrl))
+	if os.IsNotExist(err) {
+		return NewIndex(baseUrl), nil
+	} else if err != nil {
+		return nil, err
+	}
+	idx := NewIndex(baseUrl)
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, err
+	}
+	if idx.Version != indexVersion || idx.BaseUrl != baseUrl {
+		return NewIndex(baseUrl), nil
+	}
+	return idx, nil
+}
+
+func (s *Store) SaveIndex(idx *Index) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeFile(s.indexPath(idx.BaseUrl), data)
+}
@@ -0,0 +1,247 @@
+// Streaming reads of large remote files with http range requests
+
+package viewer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// size of a chunk fetched by one range request
+const streamChunkSize = 256 << 10
+
+// streamFile returns a file streaming n from its source, nil if n is
+// cached, stored or not large enough to be streamed
+func (fs *ImageFs) streamFile(n *fileNode) nodefs.File {
+	if fs.Options.StreamSize <= 0 {
+		return nil
+	}
+	if _, ok := fs.Contents.Get(n.path); ok {
+		return nil
+	}
+	fs.mu.RLock()
+	src, stored, size := n.src, n.blob != "", int64(n.attr.Size)
+	fs.mu.RUnlock()
+	if (stored && fs.Store != nil) || size <= fs.Options.StreamSize || !isCrawlUrl(src) {
+		return nil
+	}
+	log.Printf("stream %s from %s", n.path, src)
+	return newStreamFile(fs, n, src, size)
+}
+
+// streamFile serves reads of a remote file at arbitrary offsets, chunks
+// around the read offset are fetched ahead and kept in a small cache. If the
+// server ignores range requests the whole file is downloaded instead.
+type streamFile struct {
+	nodefs.File
+
+	fs   *ImageFs
+	node *fileNode
+	src  string
+	size int64
+
+	mu sync.Mutex
+
+	// fetched chunks by index, oldest first in order
+	chunks map[int64][]byte
+	order  []int64
+
+	// chunks being fetched, closed when done
+	pending map[int64]chan struct{}
+
+	// whole file after falling back to full download
+	full []byte
+
+	closed bool
+}
+
+func newStreamFile(fs *ImageFs, node *fileNode, src string, size int64) *streamFile {
+	return &streamFile{
+		File:    nodefs.NewDefaultFile(),
+		fs:      fs,
+		node:    node,
+		src:     src,
+		size:    size,
+		chunks:  make(map[int64][]byte),
+		pending: make(map[int64]chan struct{}),
+	}
+}
+
+func (f *streamFile) String() string {
+	return "streamFile(" + f.src + ")"
+}
+
+// maxChunks returns how many chunks are cached at most
+func (f *streamFile) maxChunks() int {
+	n := 4 * (f.fs.Options.StreamReadAhead + 1)
+	if n < 16 {
+		n = 16
+	}
+	return n
+}
+
+func (f *streamFile) numChunks() int64 {
+	return (f.size + streamChunkSize - 1) / streamChunkSize
+}
+
+func (f *streamFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if off >= f.size {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	end := off + int64(len(buf))
+	if end > f.size {
+		end = f.size
+	}
+	first, last := off/streamChunkSize, (end-1)/streamChunkSize
+	go f.readAhead(last + 1)
+
+	result := buf[:0]
+	for idx := first; idx <= last; idx++ {
+		data, err := f.chunk(idx)
+		if err != nil {
+			log.Printf("read %s at %d with error: %s", f.src, off, err)
+			return nil, fuse.EIO
+		}
+		start := idx * streamChunkSize
+		lo, hi := int64(0), int64(len(data))
+		if off > start {
+			lo = off - start
+		}
+		if end < start+hi {
+			hi = end - start
+		}
+		if lo >= hi {
+			break
+		}
+		result = append(result, data[lo:hi]...)
+	}
+	return fuse.ReadResultData(result), fuse.OK
+}
+
+// readAhead fetches chunks from idx in background one by one
+func (f *streamFile) readAhead(idx int64) {
+	for i := idx; i < idx+int64(f.fs.Options.StreamReadAhead) && i < f.numChunks(); i++ {
+		f.mu.Lock()
+		closed := f.closed
+		f.mu.Unlock()
+		if closed {
+			return
+		}
+		if _, err := f.chunk(i); err != nil {
+			return
+		}
+	}
+}
+
+// chunk returns data of chunk idx, it is fetched if not cached
+func (f *streamFile) chunk(idx int64) ([]byte, error) {
+	for {
+		f.mu.Lock()
+		if f.full != nil {
+			f.mu.Unlock()
+			return chunkOf(f.full, idx), nil
+		}
+		if data, ok := f.chunks[idx]; ok {
+			f.mu.Unlock()
+			return data, nil
+		}
+		if wait, ok := f.pending[idx]; ok {
+			f.mu.Unlock()
+			// the other fetch may fail, then try again
+			<-wait
+			continue
+		}
+		done := make(chan struct{})
+		f.pending[idx] = done
+		f.mu.Unlock()
+
+		data, err := f.fetch(idx)
+		f.mu.Lock()
+		delete(f.pending, idx)
+		close(done)
+		f.mu.Unlock()
+		return data, err
+	}
+}
+
+// fetch requests chunk idx with a range request, the whole file is kept if
+// the server responds with full content
+func (f *streamFile) fetch(idx int64) ([]byte, error) {
+	start := idx * streamChunkSize
+	end := start + streamChunkSize - 1
+	if end >= f.size {
+		end = f.size - 1
+	}
+	req, err := http.NewRequest("GET", f.src, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := http.DefaultClient.Do(req.WithContext(f.fs.ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		f.mu.Lock()
+		f.chunks[idx] = data
+		f.order = append(f.order, idx)
+		for len(f.order) > f.maxChunks() {
+			delete(f.chunks, f.order[0])
+			f.order = f.order[1:]
+		}
+		f.mu.Unlock()
+		return data, nil
+	case http.StatusOK:
+		log.Printf("%s does not support range requests, download it entirely", f.src)
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		f.mu.Lock()
+		f.full = data
+		f.chunks = make(map[int64][]byte)
+		f.order = nil
+		f.mu.Unlock()
+		f.fs.Contents.Put(f.node.path, data)
+		return chunkOf(data, idx), nil
+	}
+	return nil, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+func chunkOf(data []byte, idx int64) []byte {
+	start := idx * streamChunkSize
+	if start >= int64(len(data)) {
+		return nil
+	}
+	end := start + streamChunkSize
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return data[start:end]
+}
+
+func (f *streamFile) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.chunks = make(map[int64][]byte)
+	f.order = nil
+	f.full = nil
+}
+
+func (f *streamFile) GetAttr(out *fuse.Attr) fuse.Status {
+	return f.node.GetAttr(out, nil, nil)
+}
@@ -0,0 +1,91 @@
+// Thumbnails of images generated in pure Go
+
+package viewer
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// virtual directory holding jpeg thumbnails of images in every crawled
+// directory
+const ThumbsDirName = ".thumbs"
+
+// decoders accept images without pixels, they cannot be scaled
+var errEmptyImage = errors.New("image has no pixels")
+
+// thumbnail scales image data down to fit in Options.ThumbSize and encodes
+// it as jpeg with Options.ThumbQuality
+func (fs *ImageFs) thumbnail(data FileData) (FileData, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if img.Bounds().Empty() {
+		return nil, errEmptyImage
+	}
+	thumb := scaleDown(img, fs.Options.ThumbSize)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: fs.Options.ThumbQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown resizes img to fit in a size x size box keeping its aspect
+// ratio, every pixel is the average of the source pixels it covers. Images
+// are never scaled up, size 0 keeps the original dimensions. Transparent
+// pixels are blended over white as jpeg has no alpha channel. img must
+// not be empty.
+func scaleDown(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	dw, dh := sw, sh
+	if size > 0 && sw >= sh && sw > size {
+		dw, dh = size, sh*size/sw
+	} else if size > 0 && sh > sw && sh > size {
+		dw, dh = sw*size/sh, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	src, ok := img.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, sw, sh))
+		draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			var r, g, b, a uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					b += uint64(row[i+2])
+					a += uint64(row[i+3])
+				}
+			}
+			n := uint64((x1 - x0) * (y1 - y0))
+			// colors are alpha premultiplied, add the white background
+			// showing through
+			white := 255 - a/n
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r/n + white)
+			dst.Pix[i+1] = uint8(g/n + white)
+			dst.Pix[i+2] = uint8(b/n + white)
+			dst.Pix[i+3] = 255
+		}
+	}
+	return dst
+}
@@ -0,0 +1,53 @@
+package viewer
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// emptyGif is a gif of a 0x0 image, image/gif decodes it without error
+var emptyGif = []byte("GIF89a\x00\x00\x00\x00\x80\x00\x00\x00\x00\x00\xff\xff\xff" +
+	"\x2c\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x01\x2c\x00\x3b")
+
+func testPngData(w, h int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestScaleDown(t *testing.T) {
+	cases := []struct {
+		w, h, size int
+		want       image.Point
+	}{
+		{1, 1, 256, image.Pt(1, 1)},
+		{100, 50, 0, image.Pt(100, 50)},
+		{100, 50, 256, image.Pt(100, 50)},
+		{512, 256, 256, image.Pt(256, 128)},
+		{256, 512, 256, image.Pt(128, 256)},
+		{1000, 1, 10, image.Pt(10, 1)},
+		{1, 1000, 10, image.Pt(1, 10)},
+	}
+	for _, c := range cases {
+		img := image.NewRGBA(image.Rect(3, 5, 3+c.w, 5+c.h))
+		got := scaleDown(img, c.size).Bounds()
+		if got.Min != (image.Point{}) || got.Size() != c.want {
+			t.Errorf("scale %dx%d into %d: got %v, want size %v", c.w, c.h, c.size, got, c.want)
+		}
+	}
+}
+
+func TestThumbnailEmptyImage(t *testing.T) {
+	fs := newTestImageFs("")
+	defer fs.cancel()
+	if _, err := fs.thumbnail(emptyGif); err != errEmptyImage {
+		t.Errorf("thumbnail of empty image: got error %v, want %v", err, errEmptyImage)
+	}
+	if _, err := fs.thumbnail(testPngData(4, 3)); err != nil {
+		t.Errorf("thumbnail of 4x3 png: %s", err)
+	}
+}
@@ -0,0 +1,15 @@
+package viewer
+
+import (
+	"os/exec"
+)
+
+// Unmount unmounts a mount point served by another process
+func Unmount(mountpoint string) error {
+	return exec.Command("umount", mountpoint).Run()
+}
+
+// lazyUnmount forces the mount point to be unmounted even if it is busy
+func lazyUnmount(mountpoint string) error {
+	return exec.Command("umount", "-f", mountpoint).Run()
+}
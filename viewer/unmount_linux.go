@@ -0,0 +1,21 @@
+package viewer
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Unmount unmounts a mount point served by another process
+func Unmount(mountpoint string) error {
+	return exec.Command("fusermount", "-u", mountpoint).Run()
+}
+
+// lazyUnmount detaches the mount point even if it is busy
+func lazyUnmount(mountpoint string) error {
+	err := exec.Command("fusermount", "-u", "-z", mountpoint).Run()
+	if err != nil {
+		// fusermount may be missing, which is fine when running as root
+		return syscall.Unmount(mountpoint, syscall.MNT_DETACH)
+	}
+	return nil
+}
@@ -2,10 +2,13 @@ package viewer
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"net/http"
 
 	"github.com/satori/go.uuid"
 	"github.com/teris-io/shortid"
@@ -16,6 +19,16 @@ func DetectImageType(data []byte) (string, error) {
 	return fm, err
 }
 
+// ImageConfig returns the content type and dimensions of image data, the
+// content type is sniffed from data if it is not a known image format
+func ImageConfig(data []byte) (string, int, int) {
+	cfg, fm, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return http.DetectContentType(data), 0, 0
+	}
+	return "image/" + fm, cfg.Width, cfg.Height
+}
+
 func RandomId(sid *shortid.Shortid) string {
 	if sid != nil {
 		if id, err := sid.Generate(); err == nil {
@@ -24,3 +37,10 @@ func RandomId(sid *shortid.Shortid) string {
 	}
 	return uuid.NewV4().String()
 }
+
+// SourceId returns a short id derived from src, images named by it keep
+// their names across crawls
+func SourceId(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:5])
+}
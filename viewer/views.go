@@ -0,0 +1,257 @@
+// Virtual directories presenting images of a crawled directory converted
+// to another format, converted files are generated on first access
+
+package viewer
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// view is a virtual directory in every crawled directory, every image in
+// the directory that can be decoded has a converted file in it
+type view struct {
+	// name of the virtual directory
+	name string
+
+	// extensions of converted files, the first one is appended to names of
+	// images without any of them
+	exts []string
+
+	// convert generates a converted file from image data
+	convert func(fs *ImageFs, data FileData) (FileData, error)
+}
+
+var views = []*view{
+	{name: ThumbsDirName, exts: []string{".jpg", ".jpeg"}, convert: (*ImageFs).thumbnail},
+	{name: PngDirName, exts: []string{".png"}, convert: (*ImageFs).toPng},
+	{name: JpegDirName, exts: []string{".jpg", ".jpeg"}, convert: (*ImageFs).toJpeg},
+}
+
+// findView returns the view named name, nil if there is none
+func findView(name string) *view {
+	for _, v := range views {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// fileName returns the name of the converted file of image name, the
+// extension is appended unless name already has one of the view
+func (v *view) fileName(name string) string {
+	for _, ext := range v.exts {
+		if strings.EqualFold(filepath.Ext(name), ext) {
+			return name
+		}
+	}
+	return name + v.exts[0]
+}
+
+// filePath returns the full path of the converted file of file, it is
+// also the key of the converted file in content cache and index
+func (v *view) filePath(file *fileNode) string {
+	dir, name := filepath.Split(file.path)
+	return filepath.Join(dir, v.name, v.fileName(name))
+}
+
+// canConvert returns whether an image of contentType can be decoded
+func canConvert(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// viewEntries returns views listed in a crawled directory
+func viewEntries() []fuse.DirEntry {
+	entries := make([]fuse.DirEntry, 0, len(views))
+	for _, v := range views {
+		entries = append(entries, fuse.DirEntry{Name: v.name, Mode: fuse.S_IFDIR})
+	}
+	return entries
+}
+
+// viewNode is the virtual directory of view v in directory dir
+type viewNode struct {
+	baseNode
+
+	dir  *dirNode
+	view *view
+}
+
+func (fs *ImageFs) newViewNode(d *dirNode, v *view) *viewNode {
+	return &viewNode{
+		baseNode: newBaseNode(fs, filepath.Join(d.path, v.name)),
+		dir:      d,
+		view:     v,
+	}
+}
+
+func (n *viewNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	n.fs.mu.RLock()
+	mtime := time.Unix(int64(n.dir.attr.Mtime), 0)
+	n.fs.mu.RUnlock()
+	*out = n.fs.newAttr(n.path, fuse.S_IFDIR|0555, 0, mtime)
+	return fuse.OK
+}
+
+// sources returns names of converted files in the order images are listed
+// in the directory, and the images they are converted from
+func (n *viewNode) sources() ([]string, map[string]*fileNode) {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+	names := make([]string, 0)
+	files := make(map[string]*fileNode)
+	if n.dir.entries == nil {
+		return names, files
+	}
+	for _, entry := range n.dir.entries.ToDirEntries() {
+		file, ok := n.dir.children[entry.Name].(*fileNode)
+		if !ok || !canConvert(file.meta.ContentType) {
+			continue
+		}
+		name := n.view.fileName(entry.Name)
+		if _, ok := files[name]; ok {
+			continue
+		}
+		names = append(names, name)
+		files[name] = file
+	}
+	return names, files
+}
+
+func (n *viewNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	log.Printf("OpenDir name: %s", n.path)
+	names, _ := n.sources()
+	entries := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+	}
+	return entries, fuse.OK
+}
+
+func (n *viewNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	_, files := n.sources()
+	file, ok := files[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	child := file.viewFiles[n.view.name]
+	if code := child.GetAttr(out, nil, context); !code.Ok() {
+		return nil, code
+	}
+	return n.fs.attachNode(n.Inode(), name, child), fuse.OK
+}
+
+// newConvertedNode creates the converted file of file in view v
+func (fs *ImageFs) newConvertedNode(v *view, file *fileNode) *specialNode {
+	path := v.filePath(file)
+	data := func() (FileData, time.Time, fuse.Status) {
+		return fs.convertedData(v, file, path)
+	}
+	node := fs.newSpecialNode(path, 0444, data, nil)
+	// converting fetches the whole image, listing the view must not do it
+	node.stat = func() (uint64, time.Time, fuse.Status) {
+		fs.mu.RLock()
+		mtime := time.Unix(int64(file.attr.Mtime), 0)
+		fs.mu.RUnlock()
+		var size uint64
+		if data, ok := fs.Contents.Get(path); ok {
+			size = uint64(len(data))
+		}
+		return size, mtime, fuse.OK
+	}
+	return node
+}
+
+// convertedData returns the converted file of file in view v, it is
+// generated from the image data on first access and cached like images
+func (fs *ImageFs) convertedData(v *view, file *fileNode, path string) (FileData, time.Time, fuse.Status) {
+	fs.mu.RLock()
+	mtime := time.Unix(int64(file.attr.Mtime), 0)
+	hash := file.views[v.name]
+	fs.mu.RUnlock()
+
+	if data, ok := fs.Contents.Get(path); ok {
+		return data, mtime, fuse.OK
+	}
+	if hash != "" && fs.Store != nil {
+		if data, err := fs.Store.GetBlob(hash); err == nil {
+			fs.Contents.Put(path, data)
+			return data, mtime, fuse.OK
+		} else {
+			log.Printf("load blob of %s with error: %s", path, err)
+		}
+	}
+
+	orig, code := fs.fileData(file)
+	if !code.Ok() {
+		return nil, time.Time{}, code
+	}
+	data, err := v.convert(fs, orig)
+	if err != nil {
+		log.Printf("convert %s to %s with error: %s", file.path, path, err)
+		return nil, time.Time{}, fuse.EIO
+	}
+	fs.Contents.Put(path, data)
+	if fs.Store != nil {
+		if hash, err := fs.Store.PutBlob(data); err == nil {
+			fs.mu.Lock()
+			if file.views == nil {
+				file.views = make(map[string]string)
+			}
+			file.views[v.name] = hash
+			fs.mu.Unlock()
+		}
+	}
+	return data, mtime, fuse.OK
+}
+
+// dropViews drops converted files and frames of file after it changes,
+// caller must hold fs.mu
+func (fs *ImageFs) dropViews(file *fileNode) {
+	file.views = nil
+	for _, v := range views {
+		fs.Contents.Remove(v.filePath(file))
+	}
+	fs.dropFrames(file)
+}
+
+// restoreViews returns blob hashes of converted files of file saved in
+// idx, nil if there is none
+func restoreViews(idx *Index, file *fileNode) map[string]string {
+	var hashes map[string]string
+	for _, v := range views {
+		if hash, ok := idx.Blobs[v.filePath(file)]; ok {
+			if hashes == nil {
+				hashes = make(map[string]string)
+			}
+			hashes[v.name] = hash
+		}
+	}
+	return hashes
+}
+
+// invalidateViews makes the kernel drop cached converted files of the given
+// entries in directory d
+func (fs *ImageFs) invalidateViews(d *dirNode, names []string) {
+	for _, v := range views {
+		dir := d.Inode().GetChild(v.name)
+		if dir == nil {
+			continue
+		}
+		for _, name := range names {
+			if code := fs.conn.EntryNotify(dir, v.fileName(name)); !code.Ok() && code != fuse.ENOENT {
+				log.Printf("entry notify %s in %s with error: %s", name, filepath.Join(d.path, v.name), code)
+			}
+		}
+	}
+}
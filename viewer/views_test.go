@@ -0,0 +1,57 @@
+package viewer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestConvertedFileLookup(t *testing.T) {
+	var fetched int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><img src="a.png"></html>`)
+		case "/a.png":
+			atomic.AddInt32(&fetched, 1)
+			w.Write(testPngData(4, 3))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	fs := newTestImageFs(srv.URL + "/")
+	defer fs.cancel()
+	if _, err := fs.root.loadForeground(srv.URL + "/"); err != nil {
+		t.Fatalf("crawl %s: %s", srv.URL, err)
+	}
+	fetchedByCrawl := atomic.LoadInt32(&fetched)
+
+	for _, v := range views {
+		var attr fuse.Attr
+		dir, code := fs.root.Lookup(&attr, v.name, nil)
+		if !code.Ok() {
+			t.Fatalf("lookup %s: %s", v.name, code)
+		}
+		name := v.fileName("a.png")
+		first, code := dir.Node().Lookup(&attr, name, nil)
+		if !code.Ok() {
+			t.Fatalf("lookup %s/%s: %s", v.name, name, code)
+		}
+		second, code := dir.Node().Lookup(&attr, name, nil)
+		if !code.Ok() {
+			t.Fatalf("lookup %s/%s again: %s", v.name, name, code)
+		}
+		if first != second {
+			t.Errorf("lookups of %s/%s return different inodes", v.name, name)
+		}
+	}
+	if n := atomic.LoadInt32(&fetched); n != fetchedByCrawl {
+		t.Errorf("looking up converted files fetches the image %d times", n-fetchedByCrawl)
+	}
+}
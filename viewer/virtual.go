@@ -0,0 +1,173 @@
+// Virtual read only metadata files in every crawled directory
+
+package viewer
+
+import (
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	// url of the page a directory is crawled from
+	UrlFileName = ".url"
+
+	// page source fetched when crawling the directory
+	SourceFileName = ".source.html"
+
+	// provenance of every entry in the directory
+	IndexFileName = "index.json"
+)
+
+var virtualFileNames = []string{UrlFileName, SourceFileName, IndexFileName, ContactSheetFileName, GalleryFileName}
+
+type IndexEntry struct {
+	Name        string `json:"name"`
+	Dir         bool   `json:"dir,omitempty"`
+	Url         string `json:"url,omitempty"`
+	Alt         string `json:"alt,omitempty"`
+	Class       string `json:"class,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        uint64 `json:"size"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	FetchedAt   int64  `json:"fetched_at,omitempty"`
+}
+
+type DirIndex struct {
+	Url       string       `json:"url"`
+	FetchedAt int64        `json:"fetched_at"`
+	Entries   []IndexEntry `json:"entries"`
+}
+
+func isVirtualFileName(name string) bool {
+	for _, vname := range virtualFileNames {
+		if name == vname {
+			return true
+		}
+	}
+	return false
+}
+
+// isGeneratedName returns whether name is a file or directory generated in
+// every crawled directory
+func isGeneratedName(name string) bool {
+	return isVirtualFileName(name) || findView(name) != nil || isArchiveFileName(name)
+}
+
+// newVirtualNode creates virtual file name in directory d
+func (fs *ImageFs) newVirtualNode(d *dirNode, name string) *specialNode {
+	data := func() (FileData, time.Time, fuse.Status) {
+		return d.virtualContent(name)
+	}
+	node := fs.newSpecialNode(filepath.Join(d.path, name), 0444, data, nil)
+	if name == ContactSheetFileName {
+		// generating the sheet fetches every image in the directory
+		node.stat = d.contactSheetStat
+	}
+	return node
+}
+
+// virtualEntries returns virtual files listed in the directory, nil if it
+// is not crawled yet
+func (d *dirNode) virtualEntries() []fuse.DirEntry {
+	d.fs.mu.RLock()
+	page := d.page
+	d.fs.mu.RUnlock()
+	if page == nil {
+		return nil
+	}
+	entries := make([]fuse.DirEntry, 0, len(virtualFileNames)+len(views)+len(archiveFileNames))
+	for _, vname := range virtualFileNames {
+		entries = append(entries, fuse.DirEntry{Name: vname, Mode: fuse.S_IFREG})
+	}
+	entries = append(entries, viewEntries()...)
+	return append(entries, archiveEntries()...)
+}
+
+// virtualContent generates the content of virtual file name in the
+// directory, it also returns the time the directory is crawled
+func (d *dirNode) virtualContent(name string) (FileData, time.Time, fuse.Status) {
+	fs := d.fs
+	fs.mu.RLock()
+	page := d.page
+	mtime := time.Unix(int64(d.attr.Mtime), 0)
+	var index *DirIndex
+	if page != nil && name == IndexFileName {
+		index = d.dirIndex()
+	}
+	fs.mu.RUnlock()
+	if page == nil && (d.path != "" || name != GalleryFileName) {
+		return nil, time.Time{}, fuse.ENOENT
+	}
+
+	if page != nil {
+		mtime = time.Unix(page.FetchedAt, 0)
+	}
+	switch name {
+	case UrlFileName:
+		return FileData(page.Url + "\n"), mtime, fuse.OK
+	case SourceFileName:
+		if page.Html != nil {
+			return page.Html, mtime, fuse.OK
+		}
+		if page.Blob != "" && fs.Store != nil {
+			if data, err := fs.Store.GetBlob(page.Blob); err == nil {
+				return data, mtime, fuse.OK
+			}
+		}
+		return FileData{}, mtime, fuse.OK
+	case IndexFileName:
+		data, err := json.MarshalIndent(index, "", "  ")
+		if err != nil {
+			return nil, time.Time{}, fuse.EIO
+		}
+		return append(data, '\n'), mtime, fuse.OK
+	case ContactSheetFileName:
+		data, err := d.contactSheet()
+		if err != nil {
+			log.Printf("generate contact sheet of %s with error: %s", d.path, err)
+			return nil, time.Time{}, fuse.EIO
+		}
+		return data, mtime, fuse.OK
+	case GalleryFileName:
+		data, err := d.galleryContent()
+		if err != nil {
+			log.Printf("generate gallery of %s with error: %s", d.path, err)
+			return nil, time.Time{}, fuse.EIO
+		}
+		return data, mtime, fuse.OK
+	}
+	return nil, time.Time{}, fuse.ENOENT
+}
+
+// dirIndex collects provenance of all entries in the directory, caller
+// must hold fs.mu
+func (d *dirNode) dirIndex() *DirIndex {
+	index := &DirIndex{Url: d.page.Url, FetchedAt: d.page.FetchedAt, Entries: make([]IndexEntry, 0)}
+	if d.entries == nil {
+		return index
+	}
+	for _, entry := range d.entries.ToDirEntries() {
+		item := IndexEntry{Name: entry.Name}
+		switch child := d.children[entry.Name].(type) {
+		case *dirNode:
+			item.Dir = true
+			item.Url = child.url
+		case *fileNode:
+			item.Size = child.attr.Size
+			item.Url = child.src
+			item.Alt = child.meta.Alt
+			item.Class = child.meta.Class
+			item.ContentType = child.meta.ContentType
+			item.Width = child.meta.Width
+			item.Height = child.meta.Height
+			item.FetchedAt = child.meta.FetchedAt
+		}
+		index.Entries = append(index.Entries, item)
+	}
+	return index
+}
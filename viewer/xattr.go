@@ -0,0 +1,99 @@
+// Extended attributes exposing image provenance
+
+package viewer
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	XAttrSourceUrl = "user.source_url"
+	XAttrPageUrl   = "user.page_url"
+	XAttrAlt       = "user.alt"
+	XAttrClass     = "user.class"
+	XAttrMimeType  = "user.mime_type"
+	XAttrWidth     = "user.width"
+	XAttrHeight    = "user.height"
+	XAttrFetchedAt = "user.fetched_at"
+)
+
+func formatUnix(sec int64) string {
+	return time.Unix(sec, 0).UTC().Format(time.RFC3339)
+}
+
+// xattrs collects extended attributes of the directory
+func (d *dirNode) xattrs() map[string]string {
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+	attrs := make(map[string]string)
+	if d.path != "" {
+		attrs[XAttrSourceUrl] = d.url
+	}
+	if d.page != nil {
+		attrs[XAttrPageUrl] = d.page.Url
+		attrs[XAttrFetchedAt] = formatUnix(d.page.FetchedAt)
+	}
+	return attrs
+}
+
+// xattrs collects extended attributes of the file
+func (n *fileNode) xattrs() map[string]string {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+	attrs := make(map[string]string)
+	attrs[XAttrSourceUrl] = n.src
+	if n.parent.page != nil {
+		attrs[XAttrPageUrl] = n.parent.page.Url
+	}
+	attrs[XAttrAlt] = n.meta.Alt
+	attrs[XAttrClass] = n.meta.Class
+	attrs[XAttrMimeType] = n.meta.ContentType
+	if n.meta.Width > 0 && n.meta.Height > 0 {
+		attrs[XAttrWidth] = strconv.Itoa(n.meta.Width)
+		attrs[XAttrHeight] = strconv.Itoa(n.meta.Height)
+	}
+	if n.meta.FetchedAt > 0 {
+		attrs[XAttrFetchedAt] = formatUnix(n.meta.FetchedAt)
+	}
+	return attrs
+}
+
+// getXAttr returns attribute in attrs, empty values are omitted
+func getXAttr(attrs map[string]string, attribute string) ([]byte, fuse.Status) {
+	if value := attrs[attribute]; value != "" {
+		return []byte(value), fuse.OK
+	}
+	return nil, fuse.ENOATTR
+}
+
+// listXAttr returns sorted names of attrs, empty values are omitted
+func listXAttr(attrs map[string]string) ([]string, fuse.Status) {
+	result := make([]string, 0, len(attrs))
+	for k, v := range attrs {
+		if v != "" {
+			result = append(result, k)
+		}
+	}
+	sort.Strings(result)
+	return result, fuse.OK
+}
+
+func (d *dirNode) GetXAttr(attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	return getXAttr(d.xattrs(), attribute)
+}
+
+func (d *dirNode) ListXAttr(context *fuse.Context) ([]string, fuse.Status) {
+	return listXAttr(d.xattrs())
+}
+
+func (n *fileNode) GetXAttr(attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	return getXAttr(n.xattrs(), attribute)
+}
+
+func (n *fileNode) ListXAttr(context *fuse.Context) ([]string, fuse.Status) {
+	return listXAttr(n.xattrs())
+}